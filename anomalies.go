@@ -0,0 +1,84 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The anomalies command, which lists the largest hourly increments
+// of the accumulating statistics, along with the file and line of
+// the reading, so that suspicious spikes can be investigated before importing.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+var top = flag.Int("top", 10, "Number of increments listed per statistic by the anomalies command")
+
+// An hourly increment of a statistic.
+type increment struct {
+	start, end string
+	value      float32
+	src        source
+}
+
+// anomalies reads the CSV files of the jobs, and prints the largest
+// hourly increments of each accumulating statistic.
+func anomalies(jobs []*job) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, j := range jobs {
+		if _, err := j.read(context.Background()); err != nil {
+			fatalf("%v", err)
+		}
+		for _, s := range j.stats {
+			if s.mean {
+				continue
+			}
+			fmt.Fprintf(w, "Job: %s, statistic: %s\n", j.name, s.name)
+			fmt.Fprintf(w, "start\tend\tincrement\tsource\n")
+			for _, inc := range s.largestIncrements() {
+				fmt.Fprintf(w, "%s\t%s\t%.3f\t%s\n", inc.start, inc.end, inc.value, inc.src)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	w.Flush()
+}
+
+// largestIncrements returns the -top largest hourly increments of the statistic.
+func (s *stat) largestIncrements() []increment {
+	var incs []increment
+	var prev *sample
+	for _, v := range s.resampled(time.Hour) {
+		if !v.t.Truncate(time.Hour).Equal(v.t) {
+			continue
+		}
+		// Only complete hours are compared, not gaps in the readings.
+		if prev != nil && v.t.Sub(prev.t) == time.Hour {
+			incs = append(incs, increment{start: prev.t.Format(tFmt), end: v.t.Format(tFmt),
+				value: v.sum - prev.sum, src: v.src})
+		}
+		v := v
+		prev = &v
+	}
+	sort.SliceStable(incs, func(a, b int) bool { return incs[a].value > incs[b].value })
+	if len(incs) > *top {
+		incs = incs[:*top]
+	}
+	return incs
+}
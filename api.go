@@ -0,0 +1,339 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Access to the Home Assistant WebSocket API, used when
+// there is no direct access to the database.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+var haURL = flag.String("ha-url", "", "Home Assistant URL for API access e.g http://homeassistant.local:8123")
+var haToken = flag.String("ha-token", "", "Home Assistant long-lived access token")
+var haCredentials = flag.String("ha-credentials", "", "File containing the Home Assistant URL and token as HA_URL=... and HA_TOKEN=... lines")
+
+// Inside a Home Assistant add-on, the Supervisor provides a token and
+// proxies the Core API, so that no long-lived token is needed.
+const supervisorURL = "http://supervisor/core"
+const supervisorWS = "ws://supervisor/core/websocket"
+
+// credentials sets the API URL and token from, in order of precedence,
+// the flags, the HA_URL and HA_TOKEN environment variables, the
+// credentials file, and when running as an add-on, the Supervisor.
+func credentials() error {
+	set := func(url, token string) {
+		if *haURL == "" {
+			*haURL = url
+		}
+		if *haToken == "" {
+			*haToken = token
+		}
+	}
+	set(os.Getenv("HA_URL"), os.Getenv("HA_TOKEN"))
+	if *haCredentials != "" {
+		url, token, err := readCredentials(*haCredentials)
+		if err != nil {
+			return fmt.Errorf("%s: %v", *haCredentials, err)
+		}
+		set(url, token)
+	}
+	if token := os.Getenv("SUPERVISOR_TOKEN"); token != "" && *haURL == "" && *haToken == "" {
+		set(supervisorURL, token)
+	}
+	return nil
+}
+
+// readCredentials reads the URL and token from the credentials file.
+// Blank lines and lines starting with '#' are ignored.
+func readCredentials(file string) (url, token string, err error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		log.Printf("%s: warning: credentials file is accessible by other users", file)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", "", err
+	}
+	for i, l := range strings.Split(string(data), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		k, v, _ := strings.Cut(l, "=")
+		v = strings.Trim(strings.TrimSpace(v), `"'`)
+		switch strings.TrimSpace(k) {
+		case "HA_URL":
+			url = v
+		case "HA_TOKEN":
+			token = v
+		default:
+			return "", "", fmt.Errorf("%d: expected HA_URL=... or HA_TOKEN=...", i+1)
+		}
+	}
+	return url, token, nil
+}
+
+// checkToken verifies up front that the REST API accepts the token.
+func checkToken() error {
+	if *haURL == "" {
+		return fmt.Errorf("no Home Assistant URL (set -ha-url, HA_URL or -ha-credentials)")
+	}
+	if *haToken == "" {
+		return fmt.Errorf("no access token (set -ha-token, HA_TOKEN or -ha-credentials)")
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(*haURL, "/")+"/api/", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+*haToken)
+	client := http.Client{Timeout: time.Second * 30}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("access token was rejected (%s)", resp.Status)
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// How far back to first look for the latest existing statistics, with
+// each earlier period looked at being twice as long, up to the maximum.
+const apiLookback = time.Hour * 24 * 30
+const apiMaxLookback = time.Hour * 24 * 365 * 20
+
+// Connection to the Home Assistant WebSocket API.
+type haAPI struct {
+	ws *websocket.Conn
+	id int // Last message id
+}
+
+// apiMsg is a message received from the WebSocket API.
+type apiMsg struct {
+	Type    string          `json:"type"`
+	ID      int             `json:"id"`
+	Success bool            `json:"success"`
+	Result  json.RawMessage `json:"result"`
+	Error   *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	Message string `json:"message"`
+}
+
+// dialHA connects and authenticates to the Home Assistant WebSocket API.
+func dialHA(url, token string) (*haAPI, error) {
+	url = strings.TrimSuffix(url, "/")
+	wsURL := "ws" + strings.TrimPrefix(url, "http") + "/api/websocket"
+	if url == supervisorURL {
+		wsURL = supervisorWS
+	}
+	ws, err := websocket.Dial(wsURL, "", url)
+	if err != nil {
+		return nil, err
+	}
+	a := &haAPI{ws: ws}
+	var m apiMsg
+	if err := websocket.JSON.Receive(ws, &m); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	if m.Type == "auth_required" {
+		if token == "" {
+			ws.Close()
+			return nil, fmt.Errorf("no access token (set -ha-token, HA_TOKEN or -ha-credentials)")
+		}
+		if err := websocket.JSON.Send(ws, map[string]string{"type": "auth", "access_token": token}); err != nil {
+			ws.Close()
+			return nil, err
+		}
+		if err := websocket.JSON.Receive(ws, &m); err != nil {
+			ws.Close()
+			return nil, err
+		}
+	}
+	if m.Type == "auth_invalid" {
+		ws.Close()
+		return nil, fmt.Errorf("access token was rejected: %s", m.Message)
+	}
+	if m.Type != "auth_ok" {
+		ws.Close()
+		return nil, fmt.Errorf("authentication failed: %s %s", m.Type, m.Message)
+	}
+	return a, nil
+}
+
+// Close closes the API connection.
+func (a *haAPI) Close() error {
+	return a.ws.Close()
+}
+
+// call sends a command and decodes the result.
+func (a *haAPI) call(cmd map[string]interface{}, result interface{}) error {
+	a.id++
+	cmd["id"] = a.id
+	if err := websocket.JSON.Send(a.ws, cmd); err != nil {
+		return err
+	}
+	for {
+		var m apiMsg
+		if err := websocket.JSON.Receive(a.ws, &m); err != nil {
+			return err
+		}
+		// Skip any unrelated messages.
+		if m.Type != "result" || m.ID != a.id {
+			continue
+		}
+		if !m.Success {
+			if m.Error != nil {
+				return fmt.Errorf("%s: %s", m.Error.Code, m.Error.Message)
+			}
+			return fmt.Errorf("%s failed", cmd["type"])
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(m.Result, result)
+	}
+}
+
+// apiStat is one statistics record returned by the API.
+type apiStat struct {
+	Start json.RawMessage `json:"start"`
+	Sum   *float64        `json:"sum"`
+	State *float64        `json:"state"`
+}
+
+// startTime decodes the start time, which depending on the
+// Home Assistant version is either an ISO string or epoch milliseconds.
+func (s *apiStat) startTime() (time.Time, error) {
+	var ms float64
+	if err := json.Unmarshal(s.Start, &ms); err == nil {
+		return time.UnixMilli(int64(ms)).In(time.UTC), nil
+	}
+	var str string
+	if err := json.Unmarshal(s.Start, &str); err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, str)
+}
+
+// statistics returns the hourly statistics for the ids, starting from the given time.
+func (a *haAPI) statistics(ids []string, from time.Time) (map[string][]apiStat, error) {
+	return a.statisticsBetween(ids, from, time.Time{})
+}
+
+// statisticsBetween returns the hourly statistics for the ids that start
+// from the given time, and before the end time if it is set.
+func (a *haAPI) statisticsBetween(ids []string, from, to time.Time) (map[string][]apiStat, error) {
+	cmd := map[string]interface{}{
+		"type":          "recorder/statistics_during_period",
+		"start_time":    from.In(time.UTC).Format(time.RFC3339),
+		"statistic_ids": ids,
+		"period":        "hour",
+		"types":         []string{"sum", "state"},
+	}
+	if !to.IsZero() {
+		cmd["end_time"] = to.In(time.UTC).Format(time.RFC3339)
+	}
+	res := make(map[string][]apiStat)
+	err := a.call(cmd, &res)
+	return res, err
+}
+
+// hasMetadata returns true if the recorder has metadata for the statistic_id.
+func (a *haAPI) hasMetadata(id string) (bool, error) {
+	var res []map[string]interface{}
+	err := a.call(map[string]interface{}{
+		"type":          "recorder/get_statistics_metadata",
+		"statistic_ids": []string{id},
+	}, &res)
+	return len(res) != 0, err
+}
+
+// latest returns the start time and sum of the latest long term
+// statistics record for the statistic_id, or false if there is none.
+// The recent records are looked at first, then successively earlier
+// periods. If the statistic exists but no record is found, an error is
+// returned rather than none, as the sums would otherwise start again from zero.
+func (a *haAPI) latest(id string) (time.Time, float64, bool, error) {
+	to := time.Now()
+	for back := apiLookback; ; back *= 2 {
+		from := to.Add(-back)
+		res, err := a.statisticsBetween([]string{id}, from, to)
+		if err != nil {
+			return time.Time{}, 0, false, err
+		}
+		recs := res[id]
+		for i := len(recs) - 1; i >= 0; i-- {
+			if recs[i].Sum == nil {
+				continue
+			}
+			t, err := recs[i].startTime()
+			if err != nil {
+				return time.Time{}, 0, false, err
+			}
+			return t, *recs[i].Sum, true, nil
+		}
+		if len(recs) != 0 {
+			// Records without a sum, such as those of a measurement.
+			return time.Time{}, 0, false, nil
+		}
+		if back == apiLookback {
+			// A statistic without metadata has no records.
+			if ok, err := a.hasMetadata(id); err != nil || !ok {
+				return time.Time{}, 0, false, err
+			}
+		}
+		if time.Since(from) >= apiMaxLookback {
+			return time.Time{}, 0, false, fmt.Errorf("no records with a sum found in the last %d years", apiMaxLookback/(time.Hour*24*365))
+		}
+		to = from
+	}
+}
+
+// importStatistics imports long term statistics records for the statistic_id
+// via the recorder, replacing any existing records with the same start times.
+func (a *haAPI) importStatistics(s *stat, recs []map[string]interface{}) error {
+	return a.call(map[string]interface{}{
+		"type": "recorder/import_statistics",
+		"metadata": map[string]interface{}{
+			"statistic_id":        s.id,
+			"source":              "recorder",
+			"name":                nil,
+			"unit_of_measurement": s.unit,
+			"has_mean":            s.mean,
+			"has_sum":             !s.mean,
+		},
+		"stats": recs,
+	}, nil)
+}
@@ -0,0 +1,106 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// fakeRecorder serves the statistics of the recorder via the WebSocket API.
+func fakeRecorder(stats map[string][]time.Time) *httptest.Server {
+	return httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		websocket.JSON.Send(ws, map[string]string{"type": "auth_ok"})
+		for {
+			var cmd struct {
+				ID    int      `json:"id"`
+				Type  string   `json:"type"`
+				Start string   `json:"start_time"`
+				End   string   `json:"end_time"`
+				Ids   []string `json:"statistic_ids"`
+			}
+			if err := websocket.JSON.Receive(ws, &cmd); err != nil {
+				return
+			}
+			var result interface{}
+			switch cmd.Type {
+			case "recorder/get_statistics_metadata":
+				var meta []map[string]string
+				for _, id := range cmd.Ids {
+					if _, ok := stats[id]; ok {
+						meta = append(meta, map[string]string{"statistic_id": id})
+					}
+				}
+				result = meta
+			case "recorder/statistics_during_period":
+				from, _ := time.Parse(time.RFC3339, cmd.Start)
+				to, _ := time.Parse(time.RFC3339, cmd.End)
+				recs := make(map[string][]map[string]interface{})
+				for _, id := range cmd.Ids {
+					for i, t := range stats[id] {
+						if !t.Before(from) && (cmd.End == "" || t.Before(to)) {
+							recs[id] = append(recs[id], map[string]interface{}{"start": t.UnixMilli(), "sum": float64(i + 1)})
+						}
+					}
+				}
+				result = recs
+			}
+			websocket.JSON.Send(ws, map[string]interface{}{"id": cmd.ID, "type": "result", "success": true, "result": result})
+		}
+	}))
+}
+
+// The latest record is found however long ago it was.
+func TestAPILatest(t *testing.T) {
+	now := time.Now().Truncate(time.Hour).In(time.UTC)
+	day := time.Hour * 24
+	stats := map[string][]time.Time{
+		"sensor.recent": {now.Add(-day * 2), now.Add(-day)},
+		"sensor.old":    {now.Add(-day * 400), now.Add(-day * 100)},
+		"sensor.empty":  nil,
+	}
+	srv := fakeRecorder(stats)
+	defer srv.Close()
+	a, err := dialHA(srv.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	tests := []struct {
+		id   string
+		ok   bool
+		err  bool
+		want time.Time
+		sum  float64
+	}{
+		{"sensor.recent", true, false, now.Add(-day), 2},
+		{"sensor.old", true, false, now.Add(-day * 100), 2},
+		{"sensor.missing", false, false, time.Time{}, 0},
+		{"sensor.empty", false, true, time.Time{}, 0},
+	}
+	for _, tc := range tests {
+		start, sum, ok, err := a.latest(tc.id)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: error %v, expected error %v", tc.id, err, tc.err)
+			continue
+		}
+		if ok != tc.ok || !start.Equal(tc.want) || sum != tc.sum {
+			t.Errorf("%s: got %v %s %f, expected %v %s %f", tc.id, ok, start, sum, tc.ok, tc.want, tc.sum)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Direct application of the generated SQL to the database, as a single
+// transaction, rather than piping the SQL to sqlite3 by hand. Once the
+// transaction is committed, the records of each statistic are counted
+// to verify that they match what was generated.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+var applyDirect = flag.Bool("apply", false, "Apply the generated SQL directly to the -db or -database as a single transaction")
+
+// Records written to a table for a statistic, counted once applied.
+type tableCount struct {
+	table string
+	where string // Conditions of the span the records were written to
+	rows  int
+}
+
+// checkApply verifies that the SQL can be applied directly, either
+// via -apply or from the preview server.
+func checkApply() error {
+	// Without a transaction, a failed or cancelled apply would leave the tables half rewritten.
+	if *serve != "" && db != nil && !*transaction {
+		return errors.New("-serve with -db or -database requires -transaction")
+	}
+	if !*applyDirect {
+		return nil
+	}
+	if db == nil {
+		return errors.New("-apply requires -db or -database")
+	}
+	if *serve != "" {
+		return errors.New("-apply cannot be used with -serve, which applies the SQL from the preview page")
+	}
+	if !*transaction {
+		return errors.New("-apply requires -transaction")
+	}
+	return nil
+}
+
+// applyGenerated applies the generated SQL to the database, and
+// verifies the records of each statistic.
+func applyGenerated(jobs []*job) error {
+	start := time.Now()
+	n, committed, err := applyJournaled(context.Background(), db, servedSQL.Bytes())
+	if err != nil && committed {
+		return fmt.Errorf("applied, but a post-commit step failed after %s statements: %v", thousands(n), err)
+	} else if err != nil {
+		return fmt.Errorf("rolled back after %s statements: %v", thousands(n), err)
+	}
+	log.Printf("%s statements applied in %s", thousands(n), time.Since(start).Round(time.Millisecond))
+	for _, j := range jobs {
+		for _, s := range j.generated {
+			for _, c := range s.written {
+				var found int
+				q := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s = %s%s", quoteIdent(c.table), quoteIdent("metadata_id"), s.keySQL(), c.where)
+				if err := db.QueryRow(q).Scan(&found); err != nil {
+					return fmt.Errorf("%s: %v", c.table, err)
+				}
+				// Merged records are only added, so existing records may also be found.
+				if found < c.rows || (!*merge && found != c.rows) {
+					return fmt.Errorf("%s: %s: %s records found after applying, %s expected", s.name, c.table, thousands(found), thousands(c.rows))
+				}
+			}
+		}
+	}
+	log.Printf("records verified")
+	return nil
+}
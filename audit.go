@@ -0,0 +1,84 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Audit log of the imports. The generated SQL adds a row to an audit
+// table as part of the import, recording when it was applied, the
+// statistics and the number of records of each, the number of rows read,
+// a hash of the manifest of the files read, and the options used.
+// Since the row is added in the same transaction as the records, the
+// table only has rows for imports that were actually applied.
+
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var auditTable = flag.String("audit-table", "", "Name of a table that each import adds a row to e.g backfill_audit (created if it does not exist)")
+
+// auditName returns the name of the audit table.
+func auditName() string {
+	return *tablePrefix + *auditTable
+}
+
+// auditTableSQL generates the SQL to create the audit table if it does
+// not already exist. This is outside the transaction, since MySQL
+// commits any transaction in progress when a table is created.
+func auditTableSQL() {
+	if *auditTable == "" {
+		return
+	}
+	fmt.Fprintf(sqlOut, "CREATE TABLE IF NOT EXISTS %s (%s TIMESTAMP, %s VARCHAR(32), %s VARCHAR(32), %s TEXT, "+
+		"%s INTEGER, %s INTEGER, %s VARCHAR(64), %s TEXT);\n", quoteIdent(auditName()),
+		quoteIdent("applied"), quoteIdent("generated"), quoteIdent("version"), quoteIdent("statistics"),
+		quoteIdent("records"), quoteIdent("rows"), quoteIdent("manifest_sha256"), quoteIdent("options"))
+}
+
+// auditSQL generates the SQL to add the row of this import to the audit table.
+func auditSQL(jobs []*job) {
+	if *auditTable == "" {
+		return
+	}
+	var stats []string
+	for _, j := range jobs {
+		for _, s := range j.generated {
+			id := s.id
+			if s.key != 0 {
+				id = fmt.Sprint(s.key)
+			}
+			stats = append(stats, fmt.Sprintf("%s:%s=%d", s.name, id, s.generated))
+		}
+	}
+	rows, _, _ := runTotals(jobs)
+	fmt.Fprintf(sqlOut, "INSERT INTO %s (%s) VALUES (CURRENT_TIMESTAMP, '%s', %s, %s, %d, %d, '%x', %s);\n",
+		quoteIdent(auditName()), quoteIdents("applied", "generated", "version", "statistics", "records", "rows", "manifest_sha256", "options"),
+		time.Now().In(time.UTC).Format(dbTimeFmt), sqlQuote(version), sqlQuote(strings.Join(stats, ",")),
+		recordCount, rows, manifestHash(jobs), sqlQuote(options()))
+}
+
+// manifestHash returns the SHA-256 of the manifest of the files read,
+// which identifies the source data of the import.
+func manifestHash(jobs []*job) []byte {
+	h := sha256.New()
+	for _, j := range jobs {
+		for _, m := range j.manifest {
+			fmt.Fprintf(h, "%s,%s,%x\n", j.name, m.file, m.hash)
+		}
+	}
+	return h.Sum(nil)
+}
@@ -15,9 +15,9 @@
 // backfill reads the CSV files and exports the
 // historical energy values to the Home Assistant database.
 // The CSV files are assumed to be in a separate directory.
-// A directory walk is used to read the CSV files, which should
-// be in time order e.g named as yyyy-mm-dd
-// The first line of each file is assumed to be a commented header line e.g
+// A directory walk is used to find the CSV files (e.g named as yyyy-mm-dd),
+// and the rows of the files are merged in time order.
+// Each file has a header line (the first line with a date column) e.g
 //
 //    #date,time,EXP,IMP,GEN-T,...
 //
@@ -25,10 +25,10 @@
 //
 // The relevant column titles that are processed are:
 // date - to get the date
-// time - Only values on the hour are processed
-// IMP - Accumlating imported energy (kWh)
-// EXP - Accumlating exported energy (kWh)
-// GEN-T - Accumlating solar generation (kWh)
+// time - Only values on the hour are processed (if absent, daily readings are assumed)
+// IMP - Accumlating imported energy (kWh), or Import, import_kwh
+// EXP - Accumlating exported energy (kWh), or Export, export_kwh
+// GEN-T - Accumlating solar generation (kWh), or Generation, gen_kwh
 //
 // The MeterMan project generates CSV files of this format.
 //
@@ -39,204 +39,1261 @@
 package main
 
 import (
-	"encoding/csv"
+	"context"
+	"crypto/sha256"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// Tool version, recorded in the generated SQL.
+// May be overridden at build time using -ldflags "-X main.version=..."
+var version = "devel"
+
 var baseDir = flag.String("dir", "/var/cache/MeterMan/csv", "Base directory for CSV files")
+var followSymlinks = flag.Bool("follow-symlinks", false, "Follow symbolic links when reading the CSV directory")
+var skipFiles sensorList
+
+func init() {
+	flag.Var(&skipFiles, "skip-files", "Glob of the names of files or directories to skip when reading the CSV directory e.g '*.old' (may be repeated)")
+}
+
+// Names of editor and office temporary files, which are always skipped.
+var tempFiles = []string{"*~", "#*#", "~$*", "*.tmp", "*.swp", "*.bak"}
+
+var maxSize = flag.Int64("max-size", 100, "Maximum size of a CSV file in MB (0 for no limit)")
 var shortTerm = flag.Int("shortterm", 14, "Number of days to to keep short term stats")
+var shortTermWindow = flag.String("shortterm-window", "", "Absolute window of the short term stats, as FROM[,TO] dates (replaces -shortterm)")
+var longTermBefore = flag.String("longterm-before", "", "Only generate long term stats for periods starting before this date")
+var shortTermDB = flag.Bool("shortterm-db", false, "Start the short term stats at the oldest existing short term record (requires -db or -database)")
+var schema = flag.String("schema", schemaDatetime, "Database schema: datetime (created/start columns), epoch (2023.4 and later, created_ts/start_ts columns) or legacy (pre 2021.12, with last_reset); by default, detected from the database if there is one")
+var incremental = flag.Bool("incremental", false, "Only add records after the latest existing record, continuing its sum (requires -db, -database or -ha-url)")
+var transaction = flag.Bool("transaction", true, "Wrap the generated SQL in a single transaction")
+var timezone = flag.String("tz", "Local", "Time zone of the CSV times: Local, UTC or a zone name e.g Australia/Sydney")
+var attribution = flag.String("attribution", attrEnding, "Period a reading on the hour is attributed to: ending (the period ending at the reading) or starting")
+var only = flag.String("only", "", "Comma separated names of the only statistics to generate e.g import,gen")
+var exclude = flag.String("exclude", "", "Comma separated names of statistics not to generate e.g export")
+var merge = flag.Bool("merge", false, "Merge with existing records instead of replacing them (output may be safely applied more than once)")
 
 // metadata_id keys for the import, export and solar tables.
-// These can obtained from the statistics_meta table in the database
-var imp_key = flag.String("import-key", "14", "metadata_id key for import records")
-var exp_key = flag.String("export-key", "13", "metadata_id key for export records")
-var gen_key = flag.String("gen-key", "15", "metadata_id key for solar generation records")
+// These can obtained from the statistics_meta table in the database,
+// or looked up from the statistic_id.
+var imp_key = flag.String("import-key", "14", "metadata_id key for import records, or the statistic_id to look it up (by default, looked up if -import-id is set)")
+var exp_key = flag.String("export-key", "13", "metadata_id key for export records, or the statistic_id to look it up (by default, looked up if -export-id is set)")
+var gen_key = flag.String("gen-key", "15", "metadata_id key for solar generation records, or the statistic_id to look it up (by default, looked up if -gen-id is set)")
+
+// statistic_id of the import, export and solar statistics, required for API access.
+var imp_id = flag.String("import-id", "", "statistic_id for import records e.g sensor.import_total")
+var exp_id = flag.String("export-id", "", "statistic_id for export records")
+var gen_id = flag.String("gen-id", "", "statistic_id for solar generation records")
+
+// Optional power column, backfilled as a measurement (mean/min/max) statistic.
+var power_col = flag.String("power-col", "", "CSV column header of power values")
+var power_key = flag.String("power-key", "", "metadata_id key for power records")
+var power_id = flag.String("power-id", "", "statistic_id for power records")
+var power_unit = flag.String("power-unit", "W", "Unit of the power column (W or kW)")
+var power_stat_unit = flag.String("power-stat-unit", "W", "Unit of the power statistic (W or kW)")
+
+// Optional reactive energy and power factor columns, as provided by commercial meters.
+var reactive_col = flag.String("reactive-col", "", "CSV column header of reactive energy (kvarh) values")
+var reactive_key = flag.String("reactive-key", "", "metadata_id key for reactive energy records")
+var reactive_id = flag.String("reactive-id", "", "statistic_id for reactive energy records")
+var pf_col = flag.String("pf-col", "", "CSV column header of power factor values")
+var pf_key = flag.String("pf-key", "", "metadata_id key for power factor records")
+var pf_id = flag.String("pf-id", "", "statistic_id for power factor records")
+var pf_unit = flag.String("pf-unit", "", "Unit of the power factor statistic (empty for a ratio, or %)")
+
+// Power units, as a multiple of W.
+var powerUnits = map[string]float64{"W": 1, "kW": 1000}
+
+// Home Assistant API connection, if one is used.
+var api *haAPI
+
+// Location of the CSV times, from -tz.
+var csvLoc = time.Local
 
 // Format for parsing combined date/time
 const tFmt = "2006-01-02 15:04"
 
-// CSV column headers
-const h_date = "#date"
+// Database schema variants
+const schemaDatetime = "datetime" // created and start as datetime columns
+const schemaLegacy = "legacy"     // As above, but last_reset must also be set
+const schemaEpoch = "epoch"       // created_ts and start_ts as seconds since the epoch
+
+// Attribution of readings to periods
+const attrEnding = "ending"     // A reading completes the period ending at its time
+const attrStarting = "starting" // A reading is attributed to the period starting at its time
+
+// CSV column headers. Alternative spellings are separated by '|',
+// and are matched ignoring case.
+const h_date = "#date|date"
 const h_time = "time"
-const h_import = "IMP"
-const h_export = "EXP"
-const h_gen = "GEN-T"
+const h_import = "IMP|Import|import_kwh"
+const h_export = "EXP|Export|export_kwh"
+const h_gen = "GEN-T|Generation|gen_kwh"
 
 // One statistical sample
 type sample struct {
 	t     time.Time // Sample time
 	sum   float32   // Running sum
 	value float32   // value of sample
+	reset time.Time // Time the running sum was last reset
+	src   source    // Where the sample was read from
+}
+
+// Source file and line of a sample
+type source struct {
+	file string
+	line int
+}
+
+// String returns the file and line of the source, or - if there is none.
+func (src source) String() string {
+	if src.file == "" {
+		return "-"
+	}
+	return fmt.Sprintf("%s:%d", src.file, src.line)
 }
 
 // The set of all samples for one statistic
 type stat struct {
-	last   float32  // Prior sample value (to detect resets)
-	total  float32  // Accumulating total
-	values []sample // List of samples
+	name           string        // Name of statistic
+	column         string        // CSV column header, with any alternatives separated by '|'
+	key            int           // metadata_id, or 0 if only identified by statistic_id
+	id             string        // statistic_id
+	unit           string        // Unit of measurement
+	mean           bool          // Measurement (mean/min/max) rather than accumulating sum
+	signed         bool          // Total that may decrease (state_class total), rather than total_increasing
+	scale          float64       // Multiplier applied to the values
+	unitWarned     bool          // Unit conflict has been reported
+	billingId      string        // statistic_id of derived billing cycle statistic
+	costId         string        // statistic_id of derived cost statistic
+	compensationId string        // statistic_id of derived compensation statistic
+	peakId         string        // statistic_id of derived peak demand statistic
+	cycle          bool          // Billing cycle statistic, with the sum reset each cycle
+	interval       time.Duration // Length of intervals, if the values are interval data
+	resample       string        // Resampling strategy
+	profile        []float64     // Hourly weights of the profile resampling
+	billed         time.Time     // End of the billed energy, which is resampled regardless of gaps
+	final          *meterReading // Known meter reading the sums are corrected to
+	calibration    float64       // Calibration factor applied to the accumulated values (0 if none)
+	smooth         int           // Number of readings in the smoothing window (0 if none)
+	maxHourly      float64       // Maximum usage in one hour (0 if no limit)
+	window         []float32     // Readings in the smoothing window
+	last           float32       // Prior sample value (to detect resets)
+	total          float32       // Accumulating total
+	reset          time.Time     // Time of first sample or last reset
+	values         []sample      // List of samples
+	skip           []span        // Periods excluded from the import (via -review)
+	generated      int           // Number of records generated
+	written        []tableCount  // Records written to each table
+	log            *log.Logger   // Logger of the statistic's messages, if not the standard logger
 }
 
 func main() {
+	started := time.Now()
 	flag.Parse()
+	defer cleanup()
+	setupColor()
+	defer startProfiling()()
+	if err := credentials(); err != nil {
+		fatalf("%v", err)
+	}
+	// Times logged in UTC are aligned to UTC hours, rather than local hours.
+	if loc, err := time.LoadLocation(*timezone); err != nil {
+		fatalf("-tz %v", err)
+	} else {
+		csvLoc = loc
+	}
+	if err := setupFileDates(); err != nil {
+		fatalf("%v", err)
+	}
 
-	files, err := getFileNames(*baseDir)
+	if *detect {
+		files, err := getFileNames(log.Default(), *baseDir)
+		if err != nil {
+			fatalf("%s: %v", *baseDir, err)
+		}
+		if err := detectColumns(files); err != nil {
+			fatalf("%s: %v", *baseDir, err)
+		}
+		return
+	}
+	if err := applyFormat(); err != nil {
+		fatalf("-format %v", err)
+	}
+	if *demo {
+		if *configFile != "" {
+			fatalf("-demo cannot be used with -config")
+		}
+		dir, err := demoDir()
+		if dir != "" {
+			atExit(func() { os.RemoveAll(dir) })
+		}
+		if err != nil {
+			fatalf("demo: %v", err)
+		}
+		*baseDir = dir
+	}
+	jobs, err := loadJobs()
 	if err != nil {
-		log.Fatalf("%s: %v", *baseDir, err)
+		fatalf("%v", err)
 	}
-	var imp, exp, gen stat
-	// Iterate through all the files in time order, and read the CSV data.
-	for _, f := range files {
-		err := readCSV(f, &imp, &exp, &gen)
+	if err := resolveSecrets(); err != nil {
+		fatalf("%v", err)
+	}
+	switch flag.Arg(0) {
+	case "":
+	case "report":
+		report(jobs)
+		return
+	case "anomalies":
+		anomalies(jobs)
+		return
+	case "verify":
+		verify(jobs)
+		return
+	case "check-config", "snapshot", "restore":
+	case "selftest":
+		selftest()
+		return
+	default:
+		fatalf("%s: unknown command", flag.Arg(0))
+	}
+	if *schema != schemaDatetime && *schema != schemaLegacy && *schema != schemaEpoch {
+		fatalf("%s: unknown schema", *schema)
+	}
+	if *attribution != attrEnding && *attribution != attrStarting {
+		fatalf("%s: unknown attribution", *attribution)
+	}
+	if *current != currentRead && *current != currentSkip && *current != currentComplete {
+		fatalf("%s: unknown -current handling", *current)
+	}
+	if *boundary != boundaryPartial && *boundary != boundaryDrop && *boundary != boundaryProrate {
+		fatalf("%s: unknown -boundary handling", *boundary)
+	}
+	// The readings of incremental and followed imports continue on from existing hours.
+	if *boundary != boundaryPartial && (*incremental || *follow) {
+		fatalf("-boundary %s cannot be used with -incremental or -follow", *boundary)
+	}
+	if *dstGap != dstSkip && *dstGap != dstShift {
+		fatalf("%s: unknown -dst-gap handling", *dstGap)
+	}
+	for _, p := range skipFiles {
+		if _, err := filepath.Match(p, ""); err != nil {
+			fatalf("-skip-files %s: %v", p, err)
+		}
+	}
+	if err := checkTables(); err != nil {
+		fatalf("%v", err)
+	}
+	if err := checkDeleteChunk(); err != nil {
+		fatalf("%v", err)
+	}
+	// Unless explicitly set, the short term window follows the recorder's purge setting.
+	if *haConfig != "" && !flagSet("shortterm") {
+		days, err := purgeKeepDays(*haConfig)
 		if err != nil {
-			log.Printf("%s: %v\n", f, err)
-			continue
+			fatalf("%s: %v", *haConfig, err)
+		}
+		*shortTerm = days
+	}
+	if *rpcAddr != "" && *serve == "" {
+		fatalf("-rpc requires -serve")
+	}
+	if err := checkServe(); err != nil {
+		fatalf("%v", err)
+	}
+	if *haEntity != "" {
+		if *serve == "" || *haURL == "" {
+			fatalf("-ha-entity requires -serve and -ha-url")
+		}
+		if _, _, ok := strings.Cut(*haEntity, "."); !ok {
+			fatalf("-ha-entity %s: expected domain.object_id", *haEntity)
+		}
+	}
+	if *bench {
+		runBench(jobs)
+		return
+	}
+	if *follow {
+		if *haURL == "" {
+			fatalf("-follow requires -ha-url (or HA_URL or -ha-credentials)")
+		}
+		runFollow(jobs)
+		return
+	}
+	dbURL := *database
+	if *dbFile != "" {
+		if dbURL != "" {
+			fatalf("only one of -db and -database may be used")
+		}
+		dbURL = "sqlite://" + *dbFile
+	}
+	dbName := redactURL(dbURL)
+	// The preview server, or -apply, may apply the SQL to the database.
+	dbWrite = *serve != "" || *applyDirect
+	if dbURL != "" {
+		var err error
+		db, err = openDatabase(dbURL)
+		if err != nil {
+			fatalf("%s: %v", dbName, err)
+		}
+		defer db.Close()
+		// Newer recorder schemas are detected unless the schema is selected.
+		if !flagSet("schema") && detectSchema(db) {
+			log.Printf("%s: start_ts columns found, using -schema=%s", dbName, *schema)
+		}
+		// Verify the tables match the selected schema before generating anything.
+		for _, t := range []string{longName(), shortName()} {
+			if err := checkColumns(db, t, recordColumns()); err != nil {
+				fatalf("%s: schema does not match -schema=%s: %v", dbName, *schema, err)
+			}
+		}
+		err = checkColumns(db, metaName(), []string{"id", "statistic_id", "source", "unit_of_measurement", "has_mean", "has_sum", "name"})
+		if err != nil {
+			fatalf("%s: %v", dbName, err)
+		}
+		// Resolve any statistics identified only by statistic_id.
+		for _, j := range jobs {
+			for _, s := range j.stats {
+				if s.key == 0 {
+					if s.key, err = lookupKey(db, s.id); err != nil {
+						fatalf("%s: %v", s.id, err)
+					}
+					if s.key == 0 {
+						log.Printf("%s: %s not found in %s, and will be added", s.name, s.id, metaName())
+					}
+				}
+			}
+		}
+	}
+	if err := selectDialect(); err != nil {
+		fatalf("%v", err)
+	}
+	if err := checkAnalyze(); err != nil {
+		fatalf("%v", err)
+	}
+	if err := checkVacuum(); err != nil {
+		fatalf("%v", err)
+	}
+	if err := setupSchemaGuard(); err != nil {
+		fatalf("%s: %v", dbName, err)
+	}
+	if *recoverMode != "" {
+		if err := recoverJournal(); err != nil {
+			fatalf("%s: %v", dbName, err)
+		}
+		return
+	}
+	switch flag.Arg(0) {
+	case "snapshot":
+		if db == nil || flag.Arg(1) == "" {
+			fatalf("usage: snapshot requires -db or -database, and the snapshot file name")
+		}
+		if err := snapshot(flag.Arg(1), dbName); err != nil {
+			fatalf("%s: %v", flag.Arg(1), err)
+		}
+		return
+	case "restore":
+		if flag.Arg(1) == "" {
+			fatalf("usage: restore requires the snapshot file name")
+		}
+		closeOutputs, err := openOutputs()
+		if err != nil {
+			fatalf("-output %v", err)
+		}
+		if err := restore(flag.Arg(1)); err != nil {
+			fatalf("%s: %v", flag.Arg(1), err)
+		}
+		if err := sqlOut.Flush(); err != nil {
+			fatalf("output: %v", err)
+		}
+		if err := closeOutputs(); err != nil {
+			fatalf("output: %v", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "check-config" {
+		if dbURL != "" {
+			fmt.Printf("%s: database OK\n", dbName)
+		}
+		if !checkConfig(jobs) {
+			exit(1)
+		}
+		return
+	}
+	if err := checkApply(); err != nil {
+		fatalf("%v", err)
+	}
+	if err := checkJournal(); err != nil {
+		fatalf("%v", err)
+	}
+	// Refuse to add records to statistics that are missing or of the wrong kind.
+	if db != nil {
+		for _, j := range jobs {
+			for _, s := range j.stats {
+				if err := checkKey(db, s); err != nil {
+					fatalf("%s: %s: %v", dbName, s.name, err)
+				}
+			}
+		}
+	}
+	// Incremental mode adds to the existing records, which must be read
+	// from either the database or the API.
+	if *incremental {
+		*merge = true
+		if db == nil {
+			if *haURL == "" {
+				fatalf("-incremental requires -db, -database or -ha-url (or HA_URL or -ha-credentials)")
+			}
+			var err error
+			api, err = dialHA(*haURL, *haToken)
+			if err != nil {
+				fatalf("%s: %v", *haURL, err)
+			}
+			defer api.Close()
+		}
+	}
+	if *staging && *merge {
+		fatalf("-staging cannot be used with -merge or -incremental")
+	}
+	if *stitch != "" {
+		if *stitch != stitchExisting && *stitch != stitchBackfill {
+			fatalf("%s: unknown -stitch mode", *stitch)
+		}
+		if db == nil {
+			fatalf("-stitch requires -db or -database")
+		}
+		if *merge {
+			fatalf("-stitch cannot be used with -merge or -incremental")
+		}
+	}
+	// Check the token before any processing, rather than failing afterwards.
+	if notifying() {
+		if err := checkToken(); err != nil {
+			fatalf("notify: %s: %v", redactURL(*haURL), err)
+		}
+	}
+	// Windows of the long and short term statistics.
+	var long, short span
+	short.from = time.Now().In(time.UTC).Add(-time.Hour * 24 * time.Duration(*shortTerm))
+	if *longTermBefore != "" {
+		var err error
+		if long.to, err = parseDate(*longTermBefore); err != nil {
+			fatalf("-longterm-before %v", err)
+		}
+		long.partial = true
+	}
+	if *shortTermWindow != "" {
+		from, to, _ := strings.Cut(*shortTermWindow, ",")
+		short.partial = true
+		var err error
+		if short.from, err = parseDate(from); err != nil {
+			fatalf("-shortterm-window %v", err)
+		}
+		if to != "" {
+			if short.to, err = parseDate(to); err != nil {
+				fatalf("-shortterm-window %v", err)
+			}
+		}
+	}
+	if *shortTermDB {
+		if db == nil {
+			fatalf("-shortterm-db requires -db or -database")
+		}
+		oldest, ok, err := oldestShortTerm(db)
+		if err != nil {
+			fatalf("%s: %v", dbName, err)
+		}
+		if ok {
+			short.from = oldest
+		}
+	}
+	if *reconcile != "" {
+		var err error
+		if prevManifest, err = readManifest(*reconcile); err != nil {
+			fatalf("%s: %v", *reconcile, err)
+		}
+	}
+	closeOutputs, err := openOutputs()
+	if err != nil {
+		fatalf("-output %v", err)
+	}
+	closeRollback, err := openRollback()
+	if err != nil {
+		fatalf("-rollback %v", err)
+	}
+	if err := generate(context.Background(), jobs, long, short); err != nil {
+		fatalf("%v", err)
+	}
+	if err := sqlOut.Flush(); err != nil {
+		fatalf("output: %v", err)
+	}
+	if err := closeRollback(); err != nil {
+		fatalf("%v", err)
+	}
+	if err := closeOutputs(); err != nil {
+		fatalf("output: %v", err)
+	}
+	if *applyDirect {
+		if err := applyGenerated(jobs); err != nil {
+			fatalf("%s: %v", dbName, err)
+		}
+	}
+	if *manifestFile != "" {
+		if err := writeManifest(*manifestFile, jobs); err != nil {
+			fatalf("%s: %v", *manifestFile, err)
+		}
+	}
+	if *demo {
+		log.Printf("demo: %s", runSummary(jobs))
+	}
+	if *printSummary {
+		summaryTable(jobs, time.Since(started))
+	}
+	if *pushGateway != "" {
+		if err := pushMetrics(jobs, started); err != nil {
+			fatalf("%s: %v", redactURL(*pushGateway), err)
 		}
 	}
-	imp.generateSQL(*imp_key)
-	exp.generateSQL(*exp_key)
-	gen.generateSQL(*gen_key)
+	if notifying() {
+		if err := notifyHA(true, runSummary(jobs)); err != nil {
+			fatalf("notify: %v", err)
+		}
+	}
+	if *serve != "" {
+		runServer(jobs, dbName, long, short)
+	}
 }
 
-// getFileNames walks the directory and returns all the files,
-// in sorted order.
-func getFileNames(dir string) ([]string, error) {
-	var files []string
+// loadJobs creates the jobs, either from the config file or from the flags.
+func loadJobs() ([]*job, error) {
+	if *configFile != "" {
+		jobs, err := readConfig(*configFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", *configFile, err)
+		}
+		return jobs, nil
+	}
+	stats, err := flagStats()
+	if err != nil {
+		return nil, err
+	}
+	return []*job{{name: "default", dir: *baseDir, stats: stats, bills: *billsFile, billsStat: *billsStat, live: *meterMan}}, nil
+}
 
-	err := filepath.Walk(dir,
-		func(path string, info os.FileInfo, err error) error {
-			if (info.Mode() & os.ModeType) == 0 {
-				files = append(files, path)
-			}
+// generate generates the SQL for the jobs, for the long and short term
+// statistics within the spans. If the context is cancelled, generation
+// stops at the next file or statistic. The SQL is incomplete if an error
+// is returned.
+func generate(ctx context.Context, jobs []*job, long, short span) error {
+	newJournal()
+	provenance()
+	sessionSQL()
+	// Applying the SQL as a single transaction means that an interrupted
+	// import is rolled back rather than leaving the tables half rewritten.
+	// Output that is incomplete (e.g due to an error) has no COMMIT, so
+	// applying it has no effect.
+	auditTableSQL()
+	journalTableSQL()
+	if *transaction {
+		fmt.Fprintln(sqlOut, "BEGIN;")
+	}
+	schemaGuardSQL()
+	stagingSQL()
+	for _, j := range jobs {
+		if err := j.run(ctx, long, short); err != nil {
 			return err
-		})
-	sort.Strings(files)
-	return files, err
+		}
+	}
+	stagingMoveSQL()
+	auditSQL(jobs)
+	journalSQL()
+	if *transaction {
+		fmt.Fprintln(sqlOut, "COMMIT;")
+	}
+	maintenanceSQL()
+	return nil
 }
 
-// readCSV reads one CSV file and extracts the samples
-func readCSV(file string, imp, exp, gen *stat) error {
-	f, err := os.Open(file)
+// run reads the CSV files for this job and generates the SQL for its statistics.
+// When reconciling, only the records affected by changed files are generated.
+func (j *job) run(ctx context.Context, long, short span) error {
+	files, err := j.read(ctx)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	r, err := csv.NewReader(f).ReadAll()
-	if err != nil {
-		return err
+	j.sources(files)
+	if *review {
+		if err := j.review(); err != nil {
+			return err
+		}
 	}
-	// File must contain at least a header line and one line of data
-	if len(r) < 2 {
-		log.Printf("%s: empty file", file)
+	if prevManifest != nil && !j.reconciled(&long, &short) {
+		j.logger().Printf("%s: no files changed", j.name)
 		return nil
 	}
-	// Find columns in header line
-	dateCol := -1
-	timeCol := -1
-	impCol := -1
-	expCol := -1
-	genCol := -1
-	for i, s := range r[0] {
-		switch s {
-		case h_date:
-			dateCol = i
-			break
-
-		case h_time:
-			timeCol = i
-			break
-
-		case h_import:
-			impCol = i
-			break
-
-		case h_export:
-			expCol = i
-			break
-
-		case h_gen:
-			genCol = i
-			break
-		}
-	}
-	if dateCol == -1 || timeCol == -1 {
-		log.Printf("%s: cannot find date or time", file)
-		return nil
+	stats, err := j.derived()
+	if err != nil {
+		return err
+	}
+	for _, s := range stats {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		l, sh := long, short
+		l.skip, sh.skip = s.skip, s.skip
+		if *incremental {
+			if err := s.continueLatest(); err != nil {
+				return err
+			}
+		}
+		n := recordCount
+		offset := func() {}
+		if *stitch != "" {
+			if l, sh, offset, err = s.stitchTo(l, sh); err != nil {
+				return err
+			}
+		}
+		if err := s.generateSQL(l, sh); err != nil {
+			return err
+		}
+		offset()
+		s.generated = recordCount - n
+		j.generated = append(j.generated, s)
 	}
-	// Iterate through the records
-	for i, data := range r[1:] {
+	return nil
+}
+
+// derived returns the statistics read, along with any billing cycle, cost,
+// compensation or peak demand statistics derived from them, that are
+// selected via -only and -exclude.
+func (j *job) derived() ([]*stat, error) {
+	stats := j.stats
+	for _, s := range j.stats {
+		n := len(stats)
+		var d *stat
 		var err error
+		if s.billingId != "" {
+			if d, err = s.billingCycle(*billingDay); err != nil {
+				return nil, err
+			}
+			stats = append(stats, d)
+		}
+		if s.costId != "" {
+			if d, err = s.costStat(s.costId, *rate, *supplyCharge); err != nil {
+				return nil, err
+			}
+			stats = append(stats, d)
+		}
+		if s.compensationId != "" {
+			if d, err = s.costStat(s.compensationId, *feedInRate, 0); err != nil {
+				return nil, err
+			}
+			stats = append(stats, d)
+		}
+		if s.peakId != "" {
+			if d, err = s.peakDemandStat(*demandWindow, *peakPeriod); err != nil {
+				return nil, err
+			}
+			stats = append(stats, d)
+		}
+		// The periods excluded from the statistic are also excluded from those derived from it.
+		for _, d := range stats[n:] {
+			d.skip, d.log = s.skip, s.log
+		}
+	}
+	// Select the statistics to be generated.
+	var selected []*stat
+	for _, s := range stats {
+		if isSelected(s.name) {
+			selected = append(selected, s)
+		}
+	}
+	if len(selected) == 0 {
+		j.logger().Printf("%s: no statistics selected", j.name)
+	}
+	return selected, nil
+}
 
-		if len(data) != len(r[0]) {
-			log.Printf("%s: %d: Mismatch in column count", file, i+1)
-			continue
+// isSelected returns true if the statistic is selected via -only and -exclude.
+func isSelected(name string) bool {
+	return (*only == "" || inList(*only, name)) && !inList(*exclude, name)
+}
+
+// inList returns true if the name is in the comma separated list.
+func inList(list, name string) bool {
+	for _, n := range strings.Split(list, ",") {
+		if strings.TrimSpace(n) == name {
+			return true
 		}
-		t := data[dateCol] + " " + data[timeCol]
-		tm, err := time.ParseInLocation(tFmt, t, time.Local)
+	}
+	return false
+}
+
+// read reads the CSV files for this job, returning the list of files.
+// If the context is cancelled, reading stops at the next file.
+func (j *job) read(ctx context.Context) ([]string, error) {
+	for _, s := range j.stats {
+		s.log = j.log
+	}
+	var files []string
+	// A job with only bills has no directory.
+	if j.dir != "" {
+		var err error
+		files, err = getFileNames(j.logger(), j.dir)
 		if err != nil {
-			log.Printf("%s: %d: Cannot parse date (%s)", file, i+1, t)
+			return nil, fmt.Errorf("%s: %v", j.dir, err)
+		}
+	}
+	// Read the CSV data of all the files, with the rows merged in time order.
+	summaries, err := j.readFiles(ctx, files)
+	if err != nil {
+		return nil, err
+	}
+	copies := make(map[string]string)
+	for i, summary := range summaries {
+		if summary == nil {
 			continue
 		}
-		if impCol != -1 {
-			imp.addValue(data[impCol], tm)
+		if orig, ok := copies[string(summary.hash)]; ok {
+			j.logger().Printf("%s: identical to %s", files[i], orig)
+		} else {
+			copies[string(summary.hash)] = files[i]
+		}
+		j.summarize(summary)
+	}
+	// Top up with the recent readings from a running MeterMan.
+	if j.live != "" {
+		if summary, err := j.readLive(); err != nil {
+			j.logger().Printf("%s: %v", j.live, err)
+			j.errors++
+		} else {
+			j.summarize(summary)
 		}
-		if expCol != -1 {
-			exp.addValue(data[expCol], tm)
+	}
+	for _, s := range j.stats {
+		if s.maxHourly != 0 {
+			s.clampUsage()
 		}
-		if genCol != -1 {
-			gen.addValue(data[genCol], tm)
+		if s.final != nil {
+			s.correctDrift()
 		}
 	}
-	return nil
+	if j.bills != "" {
+		bills, err := readBills(j.bills)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", j.bills, err)
+		}
+		found := false
+		for _, s := range j.stats {
+			if s.name == j.billsStat && !s.mean {
+				s.addBills(bills)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: unknown statistic for bills", j.billsStat)
+		}
+	}
+	return files, nil
+}
+
+// flagStats creates the statistics defined by the command line flags.
+func flagStats() ([]*stat, error) {
+	stats := []*stat{
+		{name: "import", column: h_import, unit: "kWh", scale: 1},
+		{name: "export", column: h_export, unit: "kWh", scale: 1},
+		{name: "gen", column: h_gen, unit: "kWh", scale: 1},
+	}
+	for i, k := range []struct{ name, key, id string }{
+		{"import-key", *imp_key, *imp_id},
+		{"export-key", *exp_key, *exp_id},
+		{"gen-key", *gen_key, *gen_id},
+	} {
+		var err error
+		if stats[i].key, stats[i].id, err = energyKey(k.name, k.key, k.id); err != nil {
+			return nil, err
+		}
+	}
+	for i, f := range []string{*imp_final, *exp_final, *gen_final} {
+		if f != "" {
+			var err error
+			if stats[i].final, err = parseFinal(f); err != nil {
+				return nil, fmt.Errorf("-%s-final %v", stats[i].name, err)
+			}
+		}
+	}
+	if *power_col != "" {
+		from, ok1 := powerUnits[*power_unit]
+		to, ok2 := powerUnits[*power_stat_unit]
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("%s, %s: unknown power unit", *power_unit, *power_stat_unit)
+		}
+		key, err := optionalKey("power-key", *power_key, *power_id)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, &stat{name: "power", column: *power_col, key: key,
+			id: *power_id, unit: *power_stat_unit, mean: true, scale: from / to})
+	}
+	if *reactive_col != "" {
+		key, err := optionalKey("reactive-key", *reactive_key, *reactive_id)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, &stat{name: "reactive", column: *reactive_col, key: key,
+			id: *reactive_id, unit: "kvarh", scale: 1})
+	}
+	if *pf_col != "" {
+		if *pf_unit != "" && *pf_unit != "%" {
+			return nil, fmt.Errorf("%s: unknown power factor unit", *pf_unit)
+		}
+		key, err := optionalKey("pf-key", *pf_key, *pf_id)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, &stat{name: "pf", column: *pf_col, key: key,
+			id: *pf_id, unit: *pf_unit, mean: true, scale: 1})
+	}
+	for _, v := range sensors {
+		s, err := parseSensor(v)
+		if err != nil {
+			return nil, fmt.Errorf("-sensor %v", err)
+		}
+		stats = append(stats, s)
+	}
+	for _, v := range costColumns {
+		s, err := parseCostColumn(v)
+		if err != nil {
+			return nil, fmt.Errorf("-cost-column %v", err)
+		}
+		stats = append(stats, s)
+	}
+	if *mappingFile != "" {
+		m, err := readMapping(*mappingFile)
+		if err != nil {
+			return nil, fmt.Errorf("%v", err)
+		}
+		stats = append(stats, m...)
+	}
+	if err := setBilling(stats); err != nil {
+		return nil, fmt.Errorf("-billing %v", err)
+	}
+	if err := setCosts(stats); err != nil {
+		return nil, fmt.Errorf("-cost %v", err)
+	}
+	if err := setPeakDemand(stats); err != nil {
+		return nil, fmt.Errorf("-peak-demand %v", err)
+	}
+	if err := setInterval(stats, *interval); err != nil {
+		return nil, fmt.Errorf("-interval %v", err)
+	}
+	if err := setResample(stats); err != nil {
+		return nil, fmt.Errorf("-resample %v", err)
+	}
+	if err := setCalibration(stats); err != nil {
+		return nil, fmt.Errorf("-calibrate %v", err)
+	}
+	if err := setSmoothing(stats); err != nil {
+		return nil, fmt.Errorf("-smooth %v", err)
+	}
+	if err := setMaxHourly(stats); err != nil {
+		return nil, fmt.Errorf("-max-hourly %v", err)
+	}
+	if err := setStateClass(stats); err != nil {
+		return nil, fmt.Errorf("-state-class %v", err)
+	}
+	return stats, nil
+}
+
+// flagSet returns true if the named flag was set on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// parseKey validates a metadata_id key. The keys are integer
+// row ids in the statistics_meta table, so anything else is rejected
+// rather than being passed through to the SQL.
+func parseKey(name, key string) (int, error) {
+	k, err := strconv.Atoi(key)
+	if err != nil || k <= 0 {
+		return 0, fmt.Errorf("%s: invalid metadata_id %q (must be a positive integer)", name, key)
+	}
+	return k, nil
+}
+
+// optionalKey validates a metadata_id key that may be omitted
+// if the statistic_id is set.
+func optionalKey(name, key, id string) (int, error) {
+	if key == "" && id != "" {
+		return 0, nil
+	}
+	return parseKey(name, key)
+}
+
+// energyKey returns the metadata_id key and statistic_id of one of the
+// energy statistics. The key may be given as a statistic_id, and if only
+// the statistic_id is set the default key is not used, so that the key
+// is looked up from the statistic_id (a key of 0).
+func energyKey(name, key, id string) (int, string, error) {
+	if statIdRe.MatchString(key) {
+		if id != "" && id != key {
+			return 0, "", fmt.Errorf("-%s %s does not match the statistic_id %s", name, key, id)
+		}
+		return 0, key, nil
+	}
+	if id != "" && !flagSet(name) {
+		return 0, id, nil
+	}
+	k, err := parseKey(name, key)
+	return k, id, err
+}
+
+// getFileNames walks the directory and returns all the files,
+// in sorted order (or in date order if the file names are dated).
+// Hidden files and directories are skipped, as are
+// files that do not contain text. Entries that cannot be read are
+// reported to the logger and skipped rather than aborting the walk.
+func getFileNames(logger *log.Logger, dir string) ([]string, error) {
+	var files []string
+	err := walkDir(logger, dir, make(map[string]bool), &files)
+	sort.Strings(files)
+	if fileDateRe != nil {
+		files = orderFiles(logger, files)
+	}
+	return files, err
+}
+
+// walkDir walks one directory tree, adding the files found.
+// If symbolic links are followed, directories already visited
+// are recorded so that loops are detected.
+func walkDir(logger *log.Logger, dir string, visited map[string]bool, files *[]string) error {
+	return filepath.Walk(dir,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if path == dir {
+					return err
+				}
+				logger.Printf("%s: %v", path, err)
+				return nil
+			}
+			if path != dir && (skipFile(info.Name()) || outsideRange(path, info.IsDir())) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() && *followSymlinks {
+				real, err := filepath.EvalSymlinks(path)
+				if err == nil {
+					if visited[real] {
+						return filepath.SkipDir
+					}
+					visited[real] = true
+				}
+			}
+			if (info.Mode() & os.ModeSymlink) != 0 {
+				if *followSymlinks {
+					followLink(logger, path, visited, files)
+				}
+				return nil
+			}
+			if (info.Mode()&os.ModeType) == 0 && isText(logger, path) {
+				*files = append(*files, path)
+			}
+			return nil
+		})
+}
+
+// skipFile returns true if the file or directory name is hidden,
+// is a temporary file, or matches a -skip-files glob.
+func skipFile(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+	for _, l := range [][]string{tempFiles, skipFiles} {
+		for _, p := range l {
+			if ok, _ := filepath.Match(p, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// followLink adds the file or directory tree that the link refers to,
+// with the file paths named relative to the link.
+func followLink(logger *log.Logger, link string, visited map[string]bool, files *[]string) {
+	target, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		logger.Printf("%s: %v", link, err)
+		return
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		logger.Printf("%s: %v", link, err)
+		return
+	}
+	if !info.IsDir() {
+		if (info.Mode()&os.ModeType) == 0 && isText(logger, target) {
+			*files = append(*files, link)
+		}
+		return
+	}
+	if visited[target] {
+		logger.Printf("%s: directory already visited, skipped", link)
+		return
+	}
+	var sub []string
+	if err := walkDir(logger, target, visited, &sub); err != nil {
+		logger.Printf("%s: %v", link, err)
+	}
+	for _, f := range sub {
+		*files = append(*files, filepath.Join(link, strings.TrimPrefix(f, target)))
+	}
+}
+
+// isText checks the start of the file to determine whether
+// it is text, so that binary files (archives etc.) can be skipped.
+func isText(logger *log.Logger, path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		logger.Printf("%s: %v", path, err)
+		return false
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, err := f.Read(buf)
+	if err != nil && err != io.EOF {
+		logger.Printf("%s: %v", path, err)
+		return false
+	}
+	// Empty files are passed through, and reported when read.
+	if n != 0 && !strings.HasPrefix(http.DetectContentType(buf[:n]), "text/") {
+		logger.Printf("%s: not a text file, skipped", path)
+		return false
+	}
+	return true
+}
+
+// provenance emits SQL comments recording the tool version, options
+// and generation time, so that the output can be traced back to its inputs.
+func provenance() {
+	fmt.Fprintf(sqlOut, "-- Generated by ha-backfill %s\n", version)
+	fmt.Fprintf(sqlOut, "-- Generated at: %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(sqlOut, "-- Options: %s\n", options())
+}
+
+// options returns the settings of all the flags, without any credentials.
+func options() string {
+	var opts []string
+	flag.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		// Credentials are not recorded.
+		switch {
+		case f.Name == "database" || f.Name == "ha-url" || f.Name == "pushgateway":
+			v = redactURL(v)
+		case (f.Name == "ha-token" || f.Name == "serve-token" || f.Name == "notify-webhook") && v != "":
+			v = "xxxxx"
+		}
+		opts = append(opts, fmt.Sprintf("-%s=%s", f.Name, v))
+	})
+	return strings.Join(opts, " ")
+}
+
+// sources emits SQL comments recording the source files of the job.
+func (j *job) sources(files []string) {
+	h := sha256.New()
+	for _, f := range files {
+		fmt.Fprintln(h, f)
+	}
+	fmt.Fprintf(sqlOut, "-- Job: %s\n", j.name)
+	fmt.Fprintf(sqlOut, "-- Source directory: %s\n", j.dir)
+	fmt.Fprintf(sqlOut, "-- Source files: %d, list SHA-256: %x\n", len(files), h.Sum(nil))
+}
+
+// Summary of one CSV file that has been read.
+type fileSummary struct {
+	file    string
+	hash    []byte    // SHA-256 of the file contents
+	rows    int       // Number of rows of data used
+	skipped int       // Number of rows skipped
+	overlap int       // Number of rows already read from another source
+	first   time.Time // Time of first row
+	last    time.Time // Time of last row
+}
+
+// summarize adds the summary of a source that has been read to the
+// manifest, and logs it.
+func (j *job) summarize(summary *fileSummary) {
+	j.manifest = append(j.manifest, summary)
+	if summary.rows == 0 {
+		j.logger().Printf("%s: no rows parsed, %d skipped", summary.file, summary.skipped)
+	} else {
+		j.logger().Printf("%s: %d rows parsed, %d skipped, %s to %s", summary.file, summary.rows, summary.skipped,
+			summary.first.Format(tFmt), summary.last.Format(tFmt))
+	}
+	if summary.overlap != 0 {
+		j.logger().Printf("%s: %d rows already read from another file, ignored", summary.file, summary.overlap)
+	}
+}
+
+// parseCSV extracts the samples from CSV data read from the named source,
+// with local times in the location.
+// If after is set, only the rows after that time are used, and if until
+// is set, only the rows up to and including that time.
+func parseCSV(logger *log.Logger, file string, in io.Reader, stats []*stat, loc *time.Location, after, until time.Time) (*fileSummary, error) {
+	cs, err := newStream(logger, file, in, stats, loc, after, until)
+	if err != nil {
+		return nil, err
+	}
+	for cs.next() {
+		cs.add()
+	}
+	if cs.err != nil {
+		return nil, cs.err
+	}
+	return cs.summary, nil
+}
+
+// matchHeader returns true if the header matches any of the
+// '|' separated alternatives.
+func matchHeader(alternatives, header string) bool {
+	for _, a := range strings.Split(alternatives, "|") {
+		if strings.EqualFold(a, header) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers returns true if the time is not after the latest sample.
+func (s *stat) covers(t time.Time) bool {
+	return len(s.values) != 0 && !t.After(s.values[len(s.values)-1].t)
 }
 
 // addValue will append one value to this stat's list of values.
-func (s *stat) addValue(str string, tm time.Time) {
+// The value is scaled by the given multiplier, as well as the statistic's own.
+func (s *stat) addValue(str string, scale float64, tm time.Time, src source) {
 	f, err := strconv.ParseFloat(str, 64)
-	val := float32(f)
+	// NaN and infinite values are not readings, and cannot be written as SQL.
+	if err == nil && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		err = strconv.ErrSyntax
+	}
+	val := float32(f * scale * s.scale)
+	if s.mean {
+		// Measurements are not accumulated, and zero is a valid value.
+		if err == nil {
+			s.values = append(s.values, sample{t: tm, value: val * s.gain(), src: src})
+		}
+		return
+	}
+	if s.interval != 0 {
+		// Each value is the usage of one interval, and zero is a valid value.
+		if err == nil {
+			if len(s.values) == 0 {
+				s.reset = tm
+			}
+			s.total += val * s.gain()
+			s.values = append(s.values, sample{tm, s.total, s.total, s.reset, src})
+		}
+		return
+	}
+	// A total may decrease and pass through zero, whereas a decrease of a
+	// total_increasing counter is a reset, and zero is a missing reading.
+	if err == nil && s.signed {
+		if len(s.values) == 0 {
+			s.last = val
+			s.reset = tm
+		}
+		s.total += (val - s.last) * s.gain()
+		s.values = append(s.values, sample{tm, s.total, val, s.reset, src})
+		s.last = val
+		return
+	}
 	if err == nil && f != 0 {
-		if len(s.values) == 0 || val < s.last {
+		reset := val < s.last
+		if s.smooth != 0 {
+			val, reset = s.smoothed(val)
+		}
+		if len(s.values) == 0 || reset {
 			// Reset base if first item or value has gone backwards
 			s.last = val
+			s.reset = tm
 		}
-		s.total += val - s.last
-		s.values = append(s.values, sample{tm, s.total, val})
+		// The calibration applies to the usage, not the meter reading.
+		s.total += (val - s.last) * s.gain()
+		s.values = append(s.values, sample{tm, s.total, val, s.reset, src})
 		s.last = val
 	}
 }
 
-// generateSQL generates SQL commands to remove old statistic records
-// and to insert new records
-func (s *stat) generateSQL(key string) {
-	fmt.Printf("DELETE FROM statistics WHERE metadata_id = '%s';\n", key)
-	fmt.Printf("DELETE FROM statistics_short_term WHERE metadata_id = '%s';\n", key)
-	one_hour := time.Minute * -60
-	five_min := time.Minute * -5
-	short_term := time.Now().In(time.UTC).Add(-time.Hour * 24 * time.Duration(*shortTerm))
-	for _, v := range s.values {
-		utc := v.t.In(time.UTC)
-		if utc.Minute() == 0 {
-			v.insert("statistics", utc, one_hour, key)
-		}
-		if utc.After(short_term) {
-			v.insert("statistics_short_term", utc, five_min, key)
+// continueLatest retrieves the latest existing long term record for this
+// statistic, and continues from it.
+func (s *stat) continueLatest() error {
+	var start time.Time
+	var sum float64
+	var ok bool
+	var err error
+	if db != nil {
+		if s.key == 0 {
+			return nil
 		}
+		start, sum, ok, err = latestRecord(db, s.key)
+	} else if s.id == "" {
+		return fmt.Errorf("%s: statistic_id required for API access", s.name)
+	} else {
+		start, sum, ok, err = api.latest(s.id)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.name, err)
 	}
+	if ok {
+		s.continueFrom(start, sum)
+	}
+	return nil
 }
 
-// insert generates the SQL to insert a record into the selected table
-func (v *sample) insert(table string, tm time.Time, offset time.Duration, key string) {
-	const tf = "2006-01-02 15:04:05"
-	// Start date/time is 1 sample time before create time.
-	// Create time is offset by 10 seconds (to match what home assistant recorder does)
-	start := tm.Add(offset)
-	fmt.Printf("INSERT INTO %s (created, start, state, sum, metadata_id) "+
-		"VALUES ('%s', '%s', %f, %f, '%s');\n",
-		table, tm.Add(time.Second*10).Format(tf), start.Format(tf), v.value, v.sum, key)
+// continueFrom drops the samples covered by the existing records up to the
+// record starting at start, and offsets the sums of the remaining samples
+// so that they continue on from the sum of that record.
+func (s *stat) continueFrom(start time.Time, sum float64) {
+	// The sample that ended the record.
+	end := start.Add(time.Hour)
+	if *attribution == attrStarting {
+		end = start
+	}
+	var ref float32
+	var keep []sample
+	for _, v := range s.values {
+		if v.t.After(end) {
+			keep = append(keep, v)
+		} else {
+			ref = v.sum
+		}
+	}
+	// Billing cycle sums are not continuous, so are not offset.
+	if !s.cycle {
+		for i := range keep {
+			keep[i].sum += float32(sum) - ref
+		}
+	}
+	s.values = keep
 }
@@ -0,0 +1,165 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Benchmark mode, which reports the throughput of parsing the CSV files,
+// of generating the SQL, and of applying the SQL to a scratch SQLite
+// database with different numbers of statements per transaction,
+// to help with tuning very large backfills.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var bench = flag.Bool("bench", false, "Report the throughput of parsing, SQL generation and database writes instead of generating SQL")
+var benchBatches = flag.String("bench-batches", "1,100,1000,10000", "Comma separated numbers of statements per transaction measured by -bench")
+var benchLimit = flag.Int("bench-limit", 50000, "Maximum number of statements applied per batch size by -bench")
+
+// runBench reads the jobs' CSV files and reports the throughput of each stage.
+func runBench(jobs []*job) {
+	var batches []int
+	for _, b := range strings.Split(*benchBatches, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(b))
+		if err != nil || n <= 0 {
+			log.Fatalf("-bench-batches: %s: invalid batch size", b)
+		}
+		batches = append(batches, n)
+	}
+	dir, err := os.MkdirTemp("", "ha-backfill-bench")
+	if err != nil {
+		log.Fatalf("bench: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// The source comments written while parsing are discarded.
+	start := time.Now()
+	_, err = captureSQL(func() error {
+		for _, j := range jobs {
+			files, err := j.read(context.Background())
+			if err != nil {
+				return err
+			}
+			j.sources(files)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("bench: %v", err)
+	}
+	rows, _, _ := runTotals(jobs)
+	benchRate("parse", rows, "rows", time.Since(start))
+	start = time.Now()
+	gen, err := captureSQL(func() error {
+		for _, j := range jobs {
+			stats, err := j.derived()
+			if err != nil {
+				return err
+			}
+			for _, s := range stats {
+				if err := s.generateSQL(span{}, span{}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("bench: %v", err)
+	}
+	benchRate("generate", recordCount, "records", time.Since(start))
+	// Statistics metadata is created first, and only the inserts are timed.
+	var meta, inserts []string
+	for _, l := range strings.Split(string(gen), "\n") {
+		switch {
+		case strings.HasPrefix(l, "INSERT INTO "+quoteIdent(metaName())+" "):
+			meta = append(meta, l)
+		case strings.HasPrefix(l, "INSERT"):
+			inserts = append(inserts, l)
+		}
+	}
+	if len(inserts) > *benchLimit {
+		inserts = inserts[:*benchLimit]
+	}
+	for _, b := range batches {
+		d, err := benchDB(filepath.Join(dir, fmt.Sprintf("bench%d.db", b)), meta)
+		if err != nil {
+			log.Fatalf("bench: %v", err)
+		}
+		start = time.Now()
+		if err := applyBatches(d, inserts, b); err != nil {
+			log.Fatalf("bench: batch size %d: %v", b, err)
+		}
+		benchRate(fmt.Sprintf("write (batch %d)", b), len(inserts), "statements", time.Since(start))
+		d.Close()
+	}
+}
+
+// benchRate prints the throughput of one stage.
+func benchRate(stage string, n int, what string, d time.Duration) {
+	fmt.Printf("%-20s %10d %-10s %10.3fs %12.0f/s\n", stage, n, what, d.Seconds(), float64(n)/d.Seconds())
+}
+
+// benchDB creates a scratch database with the statistics metadata.
+func benchDB(file string, meta []string) (*sql.DB, error) {
+	d, err := sql.Open("sqlite3", "file:"+file)
+	if err != nil {
+		return nil, err
+	}
+	if err := createSchema(d); err != nil {
+		d.Close()
+		return nil, err
+	}
+	for _, m := range meta {
+		if _, err := d.Exec(m); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// applyBatches executes the statements, with the given number
+// of statements per transaction.
+func applyBatches(d *sql.DB, stmts []string, batch int) error {
+	for len(stmts) > 0 {
+		n := batch
+		if n > len(stmts) {
+			n = len(stmts)
+		}
+		tx, err := d.Begin()
+		if err != nil {
+			return err
+		}
+		for _, s := range stmts[:n] {
+			if _, err := tx.Exec(s); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		stmts = stmts[n:]
+	}
+	return nil
+}
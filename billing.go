@@ -0,0 +1,107 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Billing cycle statistics, derived from an energy statistic with
+// the sum reset at the start of each billing cycle, in the same way as
+// a utility_meter helper.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var billingDay = flag.Int("billing-day", 1, "Day of the month that billing cycles start on")
+var billing sensorList
+
+func init() {
+	flag.Var(&billing, "billing", "Billing cycle statistic for a statistic, as NAME=STATISTIC_ID e.g import=sensor.import_billing (may be repeated)")
+}
+
+// setBilling applies the -billing flags to the statistics.
+func setBilling(stats []*stat) error {
+	for _, b := range billing {
+		name, id, _ := strings.Cut(b, "=")
+		if !statIdRe.MatchString(id) {
+			return fmt.Errorf("%s: invalid statistic_id", b)
+		}
+		found := false
+		for _, s := range stats {
+			if s.name == name {
+				s.billingId = id
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: unknown statistic", b)
+		}
+	}
+	return nil
+}
+
+// cycleStart returns the start of the billing cycle that the period
+// ending at time t belongs to. If the billing day does not exist in a month,
+// the cycle starts on the last day of that month.
+func cycleStart(t time.Time, day int) time.Time {
+	t = t.Add(-time.Nanosecond)
+	y, m, d := t.Date()
+	if d < billingDate(y, m, day) {
+		m--
+	}
+	return time.Date(y, m, billingDate(y, m, day), 0, 0, 0, 0, t.Location())
+}
+
+// billingDate returns the day of the month that the billing cycle starts.
+func billingDate(y int, m time.Month, day int) int {
+	// Day 0 of the following month is the last day of this month.
+	last := time.Date(y, m+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	if day > last {
+		return last
+	}
+	return day
+}
+
+// billingCycle returns a new statistic derived from this one, with the
+// sum being the total since the start of the billing cycle.
+func (s *stat) billingCycle(day int) (*stat, error) {
+	if day < 1 || day > 31 {
+		return nil, fmt.Errorf("%d: invalid billing day", day)
+	}
+	b := &stat{name: s.billingId, column: s.column, id: s.billingId, unit: s.unit, scale: 1, cycle: true}
+	if db != nil {
+		var err error
+		if b.key, err = lookupKey(db, b.id); err != nil {
+			return nil, fmt.Errorf("%s: %v", b.id, err)
+		}
+	}
+	var start time.Time
+	var base, prev float32
+	for i, v := range s.values {
+		if cs := cycleStart(v.t, day); i == 0 || !cs.Equal(start) {
+			start = cs
+			// The running sum at the start of the cycle is that of the
+			// previous sample, which ended the previous cycle.
+			base = prev
+			if i == 0 {
+				base = v.sum
+			}
+		}
+		prev = v.sum
+		b.values = append(b.values, sample{t: v.t, sum: v.sum - base, value: v.sum - base, reset: start})
+	}
+	return b, nil
+}
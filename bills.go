@@ -0,0 +1,137 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Billed energy, used to extend the history back before any logging.
+// A bills file is a CSV file of the energy billed per month, or per
+// billing period (with the end date inclusive) e.g
+//
+//	# month,kWh
+//	2019-01,350.5
+//	2019-02,320
+//	# start,end,kWh
+//	2019-03-01,2019-04-14,610
+//
+// The energy of each period is spread evenly across it, or distributed
+// using the hourly profile if the statistic uses profile resampling.
+
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var billsFile = flag.String("bills", "", "CSV file of billed energy per month (YYYY-MM,kWh) or billing period (START,END,kWh)")
+var billsStat = flag.String("bills-stat", "import", "Name of the statistic that the billed energy is added to")
+
+// Energy billed for one period.
+type bill struct {
+	start, end time.Time
+	energy     float64
+}
+
+// readBills reads the bills file, returning the bills in time order.
+func readBills(file string) ([]bill, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	lines, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var bills []bill
+	for i, l := range lines {
+		var b bill
+		var err error
+		switch len(l) {
+		case 2:
+			if b.start, err = time.ParseInLocation("2006-01", l[0], csvLoc); err == nil {
+				b.end = b.start.AddDate(0, 1, 0)
+			}
+		case 3:
+			if b.start, err = time.ParseInLocation("2006-01-02", l[0], csvLoc); err == nil {
+				if b.end, err = time.ParseInLocation("2006-01-02", l[1], csvLoc); err == nil {
+					b.end = b.end.AddDate(0, 0, 1)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("%d: expected 2 or 3 fields", i+1)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%d: %v", i+1, err)
+		}
+		if !b.end.After(b.start) {
+			return nil, fmt.Errorf("%d: period ends before it starts", i+1)
+		}
+		b.energy, err = strconv.ParseFloat(l[len(l)-1], 64)
+		if err != nil || b.energy < 0 {
+			return nil, fmt.Errorf("%d: invalid energy (%s)", i+1, l[len(l)-1])
+		}
+		bills = append(bills, b)
+	}
+	sort.Slice(bills, func(i, j int) bool { return bills[i].start.Before(bills[j].start) })
+	for i := 1; i < len(bills); i++ {
+		if bills[i].start.Before(bills[i-1].end) {
+			return nil, fmt.Errorf("billing periods starting %s and %s overlap",
+				bills[i-1].start.Format("2006-01-02"), bills[i].start.Format("2006-01-02"))
+		}
+	}
+	return bills, nil
+}
+
+// addBills adds the billed energy to the start of the statistic,
+// with the sums of the later readings continuing on from the billed total.
+// Bills that end after the first reading are ignored.
+func (s *stat) addBills(bills []bill) {
+	var first time.Time
+	if len(s.values) != 0 {
+		first = s.values[0].t
+	}
+	var samples []sample
+	var sum float32
+	for _, b := range bills {
+		if !first.IsZero() && b.end.After(first) {
+			s.logger().Printf("%s: bill for %s overlaps the readings, ignored", s.name, b.start.Format("2006-01-02"))
+			continue
+		}
+		// Periods between bills have no energy.
+		if n := len(samples); n == 0 || !samples[n-1].t.Equal(b.start) {
+			samples = append(samples, sample{t: b.start, sum: sum, value: sum, reset: bills[0].start})
+		}
+		sum += float32(b.energy * s.scale)
+		samples = append(samples, sample{t: b.end, sum: sum, value: sum, reset: bills[0].start})
+	}
+	if len(samples) == 0 {
+		return
+	}
+	s.billed = samples[len(samples)-1].t
+	// The first reading may be at the end of the last bill.
+	if s.billed.Equal(first) {
+		samples = samples[:len(samples)-1]
+	}
+	for i := range s.values {
+		s.values[i].sum += sum
+	}
+	s.values = append(samples, s.values...)
+}
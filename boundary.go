@@ -0,0 +1,99 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Handling of the partial periods at the boundaries of the records.
+// When the first reading is not on the hour (e.g the files start part way
+// through an hour), the first hourly record only has the energy used since
+// that reading, and so is truncated. The partial hour can instead be
+// dropped, with the sums starting from the first whole hour, or its energy
+// scaled up to the whole hour. The partial hour after the last reading on
+// the hour is only generated when prorating, with its energy scaled up to
+// the whole hour in the same way.
+//
+// The end of a span (e.g -longterm-before or the end of -shortterm-window
+// in a time zone that is not a whole number of hours from UTC) may also
+// cut through a period, in which case the record of that period by default
+// has the energy of the whole period, including the energy used after the
+// cut. Dropping leaves that period as it is, and prorating scales its
+// energy down to the part of the period before the cut.
+
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+var boundary = flag.String("boundary", boundaryPartial, "Handling of the partial periods at the first and last readings and at the end of the spans: partial, drop or prorate")
+
+// Handling of the partial periods
+const boundaryPartial = "partial" // The first hour has only the energy used after the first reading
+const boundaryDrop = "drop"       // Partial periods are not generated, and the sums start from the first whole hour
+const boundaryProrate = "prorate" // The energy of partial periods is scaled to the whole period, or to the part before a cut
+
+// boundaryAdjust returns the adjustment to the sums for the partial first
+// hour, and the time up to which the readings are not used for records.
+func (s *stat) boundaryAdjust() (float32, time.Time) {
+	if *boundary == boundaryPartial || s.mean || len(s.values) == 0 {
+		return 0, time.Time{}
+	}
+	first := s.values[0]
+	for _, v := range s.resampled(time.Hour) {
+		utc := v.t.In(time.UTC)
+		if utc.Truncate(time.Hour) != utc {
+			continue
+		}
+		covered := v.t.Sub(first.t)
+		if covered == 0 || covered >= time.Hour {
+			return 0, time.Time{}
+		}
+		if *boundary == boundaryDrop {
+			return first.sum - v.sum, v.t
+		}
+		used := v.sum - first.sum
+		return used * float32(time.Hour-covered) / float32(covered), time.Time{}
+	}
+	return 0, time.Time{}
+}
+
+// boundarySpan returns the span to generate the records of the periods
+// of the given length for. When dropping, an end of the span within a
+// period is moved back to the start of that period, so that its existing
+// record is neither removed nor replaced.
+func boundarySpan(sp span, period time.Duration) span {
+	if *boundary == boundaryDrop && !sp.to.IsZero() {
+		sp.to = sp.to.Truncate(period)
+	}
+	return sp
+}
+
+// cutFraction returns the fraction of the period starting at start that
+// is before the end of the span, when prorating a period cut by the span.
+func cutFraction(start time.Time, period time.Duration, sp span) float32 {
+	if *boundary != boundaryProrate || sp.to.IsZero() || !start.Before(sp.to) || !sp.to.Before(start.Add(period)) {
+		return 1
+	}
+	return float32(sp.to.Sub(start)) / float32(period)
+}
+
+// finalPeriod returns the sum at the end of the partial period after the
+// last sample on a period boundary, prorated to the whole period, and true
+// if that period is generated.
+func finalPeriod(last, end sample, period time.Duration) (float32, bool) {
+	covered := end.t.Sub(last.t)
+	if *boundary != boundaryProrate || covered <= 0 || covered >= period {
+		return 0, false
+	}
+	return last.sum + (end.sum-last.sum)*float32(period)/float32(covered), true
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The partial periods at the first and last readings and at the end of a
+// span are kept, dropped or prorated.
+func TestBoundary(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse(tFmt, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	// readings returns readings every 10 minutes from the first to the
+	// last time, with the sum increasing by 1 each reading. A first
+	// reading on the hour is the end of the hour before.
+	readings := func(first, last string) []sample {
+		var v []sample
+		for tm := at(first); !tm.After(at(last)); tm = tm.Add(time.Minute * 10) {
+			v = append(v, sample{t: tm, sum: float32(len(v)), value: float32(len(v))})
+		}
+		return v
+	}
+	type rec struct {
+		start string
+		sum   float32
+	}
+	tests := []struct {
+		name     string
+		boundary string
+		first    string
+		last     string
+		to       string // End of the span, if any
+		want     []rec
+	}{
+		{"first hour partial", boundaryPartial, "2023-01-01 00:30", "2023-01-01 03:00", "",
+			[]rec{{"2023-01-01 00:00", 3}, {"2023-01-01 01:00", 9}, {"2023-01-01 02:00", 15}}},
+		{"first hour dropped", boundaryDrop, "2023-01-01 00:30", "2023-01-01 03:00", "",
+			[]rec{{"2023-01-01 01:00", 6}, {"2023-01-01 02:00", 12}}},
+		{"first hour prorated", boundaryProrate, "2023-01-01 00:30", "2023-01-01 03:00", "",
+			[]rec{{"2023-01-01 00:00", 6}, {"2023-01-01 01:00", 12}, {"2023-01-01 02:00", 18}}},
+		{"last hour partial", boundaryPartial, "2023-01-01 00:00", "2023-01-01 02:20", "",
+			[]rec{{"2022-12-31 23:00", 0}, {"2023-01-01 00:00", 6}, {"2023-01-01 01:00", 12}}},
+		{"last hour dropped", boundaryDrop, "2023-01-01 00:00", "2023-01-01 02:20", "",
+			[]rec{{"2022-12-31 23:00", 0}, {"2023-01-01 00:00", 6}, {"2023-01-01 01:00", 12}}},
+		{"last hour prorated", boundaryProrate, "2023-01-01 00:00", "2023-01-01 02:20", "",
+			[]rec{{"2022-12-31 23:00", 0}, {"2023-01-01 00:00", 6}, {"2023-01-01 01:00", 12}, {"2023-01-01 02:00", 18}}},
+		{"cut partial", boundaryPartial, "2023-01-01 00:00", "2023-01-01 04:00", "2023-01-01 01:30",
+			[]rec{{"2022-12-31 23:00", 0}, {"2023-01-01 00:00", 6}, {"2023-01-01 01:00", 12}}},
+		{"cut dropped", boundaryDrop, "2023-01-01 00:00", "2023-01-01 04:00", "2023-01-01 01:30",
+			[]rec{{"2022-12-31 23:00", 0}, {"2023-01-01 00:00", 6}}},
+		{"cut prorated", boundaryProrate, "2023-01-01 00:00", "2023-01-01 04:00", "2023-01-01 01:30",
+			[]rec{{"2022-12-31 23:00", 0}, {"2023-01-01 00:00", 6}, {"2023-01-01 01:00", 9}}},
+		{"cut on the hour", boundaryProrate, "2023-01-01 00:00", "2023-01-01 04:00", "2023-01-01 02:00",
+			[]rec{{"2022-12-31 23:00", 0}, {"2023-01-01 00:00", 6}, {"2023-01-01 01:00", 12}}},
+		{"both ends prorated", boundaryProrate, "2023-01-01 00:30", "2023-01-01 02:20", "",
+			[]rec{{"2023-01-01 00:00", 6}, {"2023-01-01 01:00", 12}, {"2023-01-01 02:00", 18}}},
+	}
+	saved := *boundary
+	defer func() { *boundary = saved }()
+	for _, tc := range tests {
+		*boundary = tc.boundary
+		s := &stat{name: "import", values: readings(tc.first, tc.last)}
+		var sp span
+		if tc.to != "" {
+			sp = span{to: at(tc.to), partial: true}
+		}
+		recs := s.records(time.Hour, boundarySpan(sp, time.Hour))
+		var got []rec
+		for _, r := range recs {
+			got = append(got, rec{r.start.Format(tFmt), r.sum})
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got records %v, expected %v", tc.name, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s: got records %v, expected %v", tc.name, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+// When dropping, the end of a span within a period is moved back to the start of the period.
+func TestBoundarySpan(t *testing.T) {
+	to := time.Date(2023, 1, 1, 13, 30, 0, 0, time.UTC)
+	saved := *boundary
+	defer func() { *boundary = saved }()
+	for _, b := range []string{boundaryPartial, boundaryDrop, boundaryProrate} {
+		*boundary = b
+		want := to
+		if b == boundaryDrop {
+			want = to.Truncate(time.Hour)
+		}
+		if got := boundarySpan(span{to: to, partial: true}, time.Hour).to; !got.Equal(want) {
+			t.Errorf("%s: span ends at %s, expected %s", b, got, want)
+		}
+		if got := boundarySpan(span{to: to, partial: true}, time.Minute*5).to; !got.Equal(to) {
+			t.Errorf("%s: short term span ends at %s, expected %s", b, got, to)
+		}
+	}
+}
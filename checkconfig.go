@@ -0,0 +1,160 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The check-config command, which validates the configuration
+// (from the config file or the flags) without processing any data.
+// Only the header lines of the CSV files are read.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+)
+
+// checkConfig reports any problems with the jobs' configuration,
+// returning false if there were any.
+func checkConfig(jobs []*job) bool {
+	problems := 0
+	problem := func(j *job, format string, v ...interface{}) {
+		fmt.Printf("%s: %s\n", j.name, fmt.Sprintf(format, v...))
+		problems++
+	}
+	keys := make(map[int]string)
+	ids := make(map[string]string)
+	for _, j := range jobs {
+		// Every column must be found in the header of at least one file.
+		var headers [][]string
+		if j.dir != "" {
+			files, err := getFileNames(j.logger(), j.dir)
+			if err != nil {
+				problem(j, "%s: %v", j.dir, err)
+			} else if len(files) == 0 {
+				problem(j, "%s: no CSV files found", j.dir)
+			}
+			for _, f := range files {
+				if h, err := readHeader(f); err == nil {
+					headers = append(headers, h)
+				}
+			}
+		}
+		for _, s := range j.stats {
+			if j.dir != "" && !columnFound(s, headers) {
+				problem(j, "%s: column not found in any file", s.column)
+			}
+			// Each statistic must be written by only one column.
+			if s.key != 0 {
+				if c, ok := keys[s.key]; ok {
+					problem(j, "%s: key %d is also used by %s", s.column, s.key, c)
+				}
+				keys[s.key] = s.column
+			}
+			if s.id != "" {
+				if c, ok := ids[s.id]; ok {
+					problem(j, "%s: %s is also used by %s", s.column, s.id, c)
+				}
+				ids[s.id] = s.column
+			}
+			if db != nil {
+				if err := checkKey(db, s); err != nil {
+					problem(j, "%s: %v", s.column, err)
+				}
+			}
+		}
+		// Billing periods must not overlap, and must be added to a known statistic.
+		if j.bills != "" {
+			if _, err := readBills(j.bills); err != nil {
+				problem(j, "%s: %v", j.bills, err)
+			}
+			found := false
+			for _, s := range j.stats {
+				found = found || (s.name == j.billsStat && !s.mean)
+			}
+			if !found {
+				problem(j, "%s: unknown statistic for bills", j.billsStat)
+			}
+		}
+	}
+	if problems != 0 {
+		fmt.Printf("%d problems found\n", problems)
+		return false
+	}
+	fmt.Println("Configuration OK")
+	return true
+}
+
+// readHeader returns the header line of a CSV file, with any units.
+func readHeader(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, _, err := csvReader(f)
+	if err != nil {
+		return nil, err
+	}
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	if row, err := r.Read(); err == nil {
+		addUnits(header, row)
+	}
+	return header, nil
+}
+
+// columnFound returns true if the statistic's column is in any of the headers,
+// with or without units.
+func columnFound(s *stat, headers [][]string) bool {
+	for _, h := range headers {
+		for _, c := range h {
+			base, unit := splitUnit(c)
+			if matchHeader(s.column, c) || (unit != "" && matchHeader(s.column, base)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkKey verifies that the statistic's metadata_id exists, is
+// consistent with its statistic_id if both are set, and is a sum or
+// mean statistic as expected. Records added to a missing or mismatched
+// statistic would never be shown by Home Assistant.
+func checkKey(d *sql.DB, s *stat) error {
+	if s.key == 0 {
+		return nil
+	}
+	var id string
+	var hasMean, hasSum sql.NullBool
+	err := d.QueryRow(bindVars("SELECT statistic_id, has_mean, has_sum FROM "+metaName()+" WHERE id = ?"), s.key).Scan(&id, &hasMean, &hasSum)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("key %d not found in %s", s.key, metaName())
+	}
+	if err != nil {
+		return err
+	}
+	if s.id != "" && s.id != id {
+		return fmt.Errorf("key %d is %s, not %s", s.key, id, s.id)
+	}
+	if s.mean && !hasMean.Bool {
+		return fmt.Errorf("key %d (%s) does not have has_mean set, but is a measurement", s.key, id)
+	}
+	if !s.mean && !hasSum.Bool {
+		return fmt.Errorf("key %d (%s) does not have has_sum set, but is a sum", s.key, id)
+	}
+	return nil
+}
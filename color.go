@@ -0,0 +1,112 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Colored terminal output. Errors and warnings in the log are colored,
+// and when the SQL is written to a terminal, the statements that remove or
+// change existing data are highlighted. Color is only used on a terminal,
+// and is disabled by -no-color or the NO_COLOR environment variable.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+var noColor = flag.Bool("no-color", false, "Disable colored output on a terminal (as does setting NO_COLOR)")
+
+// ANSI escape sequences
+const (
+	colorRed    = "\x1b[31m"
+	colorYellow = "\x1b[33m"
+	colorBold   = "\x1b[1;31m"
+	colorReset  = "\x1b[0m"
+)
+
+// Log messages that are errors or warnings. Counts of skipped rows
+// are only a warning if they are not zero.
+var errorRe = regexp.MustCompile(`(?i)error|failed|cannot|invalid|unknown|not found|no such file|does not match`)
+var warningRe = regexp.MustCompile(`(?i)warning|[^0-9 ]skipped|[1-9][0-9]* skipped|ignored|clamped|dropped|exceeds`)
+
+// Statements that remove or change existing data.
+var destructive = []string{"DELETE", "UPDATE", "DROP", "VACUUM"}
+
+// setupColor colors the log, and the SQL, if they are written to a terminal.
+func setupColor() {
+	if !useColor(os.Stderr) {
+		return
+	}
+	log.SetOutput(&colorWriter{w: os.Stderr, color: logColor})
+	if useColor(os.Stdout) {
+		setOutput(&colorWriter{w: os.Stdout, color: sqlColor})
+	}
+}
+
+// useColor returns true if the file is a terminal that color may be used on.
+func useColor(f *os.File) bool {
+	return !*noColor && os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb" && term.IsTerminal(int(f.Fd()))
+}
+
+// logColor returns the color of a log message.
+func logColor(line string) string {
+	switch {
+	case errorRe.MatchString(line):
+		return colorRed
+	case warningRe.MatchString(line):
+		return colorYellow
+	}
+	return ""
+}
+
+// sqlColor returns the color of an SQL statement.
+func sqlColor(line string) string {
+	for _, d := range destructive {
+		if strings.HasPrefix(line, d) {
+			return colorBold
+		}
+	}
+	return ""
+}
+
+// colorWriter colors each complete line written to it.
+type colorWriter struct {
+	w       io.Writer
+	color   func(string) string
+	partial []byte // Incomplete last line
+}
+
+func (c *colorWriter) Write(p []byte) (int, error) {
+	c.partial = append(c.partial, p...)
+	for {
+		i := bytes.IndexByte(c.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := string(c.partial[:i])
+		c.partial = c.partial[i+1:]
+		if col := c.color(line); col != "" {
+			line = col + line + colorReset
+		}
+		if _, err := io.WriteString(c.w, line+"\n"); err != nil {
+			return 0, err
+		}
+	}
+}
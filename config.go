@@ -0,0 +1,439 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Configuration file, defining one or more backfill jobs.
+// The file is JSON e.g
+//
+//	{
+//	  "database": "!secret recorder_db_url",
+//	  "jobs": [
+//	    {
+//	      "name": "electricity",
+//	      "dir": "/var/cache/MeterMan/csv",
+//	      "statistics": [
+//	        { "column": "IMP|Import", "key": 14 },
+//	        { "column": "EXP", "key": 13 },
+//	        { "column": "TEMP", "id": "sensor.outside_temperature", "unit": "°C", "mean": true }
+//	      ]
+//	    },
+//	    {
+//	      "name": "circuits",
+//	      "dir": "/var/cache/circuits/csv",
+//	      "mapping": "/etc/ha-backfill/circuits.csv"
+//	    },
+//	    {
+//	      "name": "gas",
+//	      "dir": "/var/cache/gas/csv",
+//	      "statistics": [
+//	        { "column": "GAS", "id": "sensor.gas_total", "unit": "m³" }
+//	      ]
+//	    },
+//	    {
+//	      "name": "sheds",
+//	      "dir": "/var/cache/sheds/csv",
+//	      "devices": [
+//	        {
+//	          "name": "meter",
+//	          "timezone": "UTC",
+//	          "calibration": 0.98,
+//	          "state_class": "total",
+//	          "statistics": [
+//	            { "column": "IN", "id": "sensor.shed_import" },
+//	            { "column": "OUT", "id": "sensor.shed_export" }
+//	          ]
+//	        }
+//	      ]
+//	    }
+//	  ]
+//	}
+//
+// The statistics of a device (e.g a meter or logger) share its timezone,
+// calibration and state class (which sets how resets of its meters are
+// handled), unless set for a statistic. A device with its own timezone
+// is read as a separate job named JOB/DEVICE.
+//
+// A mapping file is a CSV file mapping column names to statistics,
+// for CSV files where many columns are each a different entity e.g
+//
+//	# column,key or statistic_id,unit,sum, total or mean
+//	CCT1,sensor.kitchen_energy,kWh
+//	CCT2,21
+//	NET,sensor.net_energy,kWh,total
+//	TEMP,sensor.outside_temperature,°C,mean
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var configFile = flag.String("config", "", "Configuration file defining the backfill jobs (replaces the statistic flags)")
+var mappingFile = flag.String("mapping", "", "CSV file mapping column names to statistics")
+
+// Configuration file layout.
+type config struct {
+	// Credentials, used unless set by flags. These may refer to secrets as "!secret NAME".
+	Database string      `json:"database"`
+	HAURL    string      `json:"ha_url"`
+	HAToken  string      `json:"ha_token"`
+	Jobs     []jobConfig `json:"jobs"`
+}
+
+type jobConfig struct {
+	Name       string         `json:"name"`
+	Dir        string         `json:"dir"`
+	Mapping    string         `json:"mapping"`
+	Interval   string         `json:"interval"`   // Length of intervals of interval data e.g "30m"
+	Timezone   string         `json:"timezone"`   // Timezone of the readings, defaults to -tz
+	Bills      string         `json:"bills"`      // CSV file of billed energy
+	BillsStat  string         `json:"bills_stat"` // Column of the statistic the bills are added to
+	MeterMan   string         `json:"meterman"`   // URL of a running MeterMan's recent readings
+	Statistics []statConfig   `json:"statistics"`
+	Devices    []deviceConfig `json:"devices"`
+	// All the jobs share one target, so that they are imported as one
+	// transaction; these are only read so that they can be refused.
+	Database string `json:"database"`
+	Output   string `json:"output"`
+}
+
+// A device groups the statistics read from one meter or logger,
+// with options shared by its statistics.
+type deviceConfig struct {
+	Name        string       `json:"name"`
+	Timezone    string       `json:"timezone"`    // Timezone of the readings, defaults to the job's
+	Calibration float64      `json:"calibration"` // Calibration factor of the meters
+	StateClass  string       `json:"state_class"` // State class of the meters: total_increasing or total
+	Statistics  []statConfig `json:"statistics"`
+}
+
+type statConfig struct {
+	Column string  `json:"column"` // CSV column header, alternatives separated by '|'
+	Key    int     `json:"key"`    // metadata_id
+	Id     string  `json:"id"`     // statistic_id, used if key is not set
+	Unit   string  `json:"unit"`   // Unit of measurement
+	Mean   bool    `json:"mean"`   // Measurement rather than accumulating meter
+	Scale  float64 `json:"scale"`  // Multiplier for values, default 1
+	// statistic_id of a derived billing cycle statistic
+	BillingId string `json:"billing_id"`
+	// statistic_id of a derived cost statistic
+	CostId string `json:"cost_id"`
+	// statistic_id of a derived compensation statistic
+	CompensationId string `json:"compensation_id"`
+	// statistic_id of a derived peak demand statistic
+	PeakId string `json:"peak_demand_id"`
+	// Resampling strategy: exact, last, linear or spread
+	Resample string `json:"resample"`
+	// Hourly profile of the profile resampling, defaults to -profile
+	Profile string `json:"profile"`
+	// Known meter reading as VALUE@DATE, that the sums are corrected to
+	Final string `json:"final"`
+	// Calibration factor applied to the values e.g 0.97 for a meter reading 3% high
+	Calibration float64 `json:"calibration"`
+	// Number of readings in the smoothing window of a noisy counter
+	Smooth int `json:"smooth"`
+	// Maximum usage in one hour, above which the usage is clamped or dropped
+	MaxHourly float64 `json:"max_hourly"`
+	// State class of the source: total_increasing (the default) or total
+	StateClass string `json:"state_class"`
+}
+
+// A job reads one directory of CSV files and generates its statistics.
+type job struct {
+	name      string
+	dir       string
+	stats     []*stat
+	manifest  []*fileSummary // Files that have been read
+	bills     string         // Bills file, if any
+	billsStat string         // Name of the statistic the bills are added to
+	errors    int            // Number of files that could not be read
+	live      string         // URL of a running MeterMan, if any
+	loc       *time.Location // Timezone of the readings, if not -tz
+	generated []*stat        // Statistics generated, including derived statistics
+	log       *log.Logger    // Logger of the job's messages, if not the standard logger
+}
+
+// readConfig reads the configuration file and creates the jobs.
+func readConfig(file string) ([]*job, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var c config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	if len(c.Jobs) == 0 {
+		return nil, fmt.Errorf("no jobs defined")
+	}
+	for _, s := range []struct {
+		flag  *string
+		value string
+	}{{database, c.Database}, {haURL, c.HAURL}, {haToken, c.HAToken}} {
+		if *s.flag == "" {
+			*s.flag = s.value
+		}
+	}
+	var jobs []*job
+	for i, jc := range c.Jobs {
+		j := &job{name: jc.Name, dir: jc.Dir, bills: jc.Bills, billsStat: jc.BillsStat, live: jc.MeterMan}
+		if j.name == "" {
+			j.name = fmt.Sprintf("job %d", i+1)
+		}
+		if jc.Timezone != "" {
+			if j.loc, err = time.LoadLocation(jc.Timezone); err != nil {
+				return nil, fmt.Errorf("%s: %v", j.name, err)
+			}
+		}
+		if j.bills != "" && j.billsStat == "" {
+			return nil, fmt.Errorf("%s: bills_stat is required with bills", j.name)
+		}
+		if jc.Database != "" || jc.Output != "" {
+			return nil, fmt.Errorf("%s: a job cannot set its own database or output, which are shared by all the jobs", j.name)
+		}
+		if j.dir == "" && j.bills == "" && j.live == "" {
+			return nil, fmt.Errorf("%s: no directory", j.name)
+		}
+		for _, sc := range jc.Statistics {
+			s, err := sc.newStat()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", j.name, err)
+			}
+			j.stats = append(j.stats, s)
+		}
+		if jc.Mapping != "" {
+			stats, err := readMapping(jc.Mapping)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", j.name, err)
+			}
+			j.stats = append(j.stats, stats...)
+		}
+		devJobs, err := j.addDevices(jc.Devices)
+		if err != nil {
+			return nil, err
+		}
+		if jc.Interval != "" {
+			d, err := time.ParseDuration(jc.Interval)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", j.name, err)
+			}
+			for _, dj := range append([]*job{j}, devJobs...) {
+				if err := setInterval(dj.stats, d); err != nil {
+					return nil, fmt.Errorf("%s: %v", dj.name, err)
+				}
+			}
+		}
+		// A job whose statistics are all read by devices in other timezones is replaced by them.
+		if len(j.stats) != 0 {
+			jobs = append(jobs, j)
+		} else if len(devJobs) == 0 || j.bills != "" {
+			return nil, fmt.Errorf("%s: no statistics", j.name)
+		}
+		jobs = append(jobs, devJobs...)
+	}
+	return jobs, nil
+}
+
+// addDevices adds the statistics of the devices to the job, with the
+// device's options applied. The statistics of devices with their own
+// timezone are returned as separate jobs reading the same files.
+func (j *job) addDevices(devices []deviceConfig) ([]*job, error) {
+	var jobs []*job
+	for i, dc := range devices {
+		name := dc.Name
+		if name == "" {
+			name = fmt.Sprintf("device %d", i+1)
+		}
+		dj := j
+		if dc.Timezone != "" {
+			loc, err := time.LoadLocation(dc.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("%s/%s: %v", j.name, name, err)
+			}
+			if loc.String() != j.location().String() {
+				dj = &job{name: j.name + "/" + name, dir: j.dir, live: j.live, loc: loc}
+				jobs = append(jobs, dj)
+			}
+		}
+		for _, sc := range dc.Statistics {
+			// The device's options apply to its meters, unless set for the statistic.
+			if !sc.Mean {
+				if sc.Calibration == 0 {
+					sc.Calibration = dc.Calibration
+				}
+				if sc.StateClass == "" {
+					sc.StateClass = dc.StateClass
+				}
+			}
+			s, err := sc.newStat()
+			if err != nil {
+				return nil, fmt.Errorf("%s/%s: %v", j.name, name, err)
+			}
+			dj.stats = append(dj.stats, s)
+		}
+		if len(dc.Statistics) == 0 {
+			return nil, fmt.Errorf("%s/%s: no statistics", j.name, name)
+		}
+	}
+	return jobs, nil
+}
+
+// location returns the timezone of the job's readings.
+func (j *job) location() *time.Location {
+	if j.loc != nil {
+		return j.loc
+	}
+	return csvLoc
+}
+
+// logger returns the logger of the job's messages.
+func (j *job) logger() *log.Logger {
+	if j.log != nil {
+		return j.log
+	}
+	return log.Default()
+}
+
+// logger returns the logger of the statistic's messages, which is that of its job.
+func (s *stat) logger() *log.Logger {
+	if s.log != nil {
+		return s.log
+	}
+	return log.Default()
+}
+
+// newStat validates the statistic configuration and creates the statistic.
+func (sc *statConfig) newStat() (*stat, error) {
+	if sc.Column == "" {
+		return nil, fmt.Errorf("statistic with no column")
+	}
+	if sc.Key < 0 || (sc.Key == 0 && !statIdRe.MatchString(sc.Id)) {
+		return nil, fmt.Errorf("%s: a metadata_id key or a valid statistic_id is required", sc.Column)
+	}
+	if sc.BillingId != "" && (sc.Mean || !statIdRe.MatchString(sc.BillingId)) {
+		return nil, fmt.Errorf("%s: invalid billing_id", sc.Column)
+	}
+	if sc.CostId != "" && (sc.Mean || !statIdRe.MatchString(sc.CostId)) {
+		return nil, fmt.Errorf("%s: invalid cost_id", sc.Column)
+	}
+	if sc.CompensationId != "" && (sc.Mean || !statIdRe.MatchString(sc.CompensationId)) {
+		return nil, fmt.Errorf("%s: invalid compensation_id", sc.Column)
+	}
+	if sc.PeakId != "" && (sc.Mean || !statIdRe.MatchString(sc.PeakId)) {
+		return nil, fmt.Errorf("%s: invalid peak_demand_id", sc.Column)
+	}
+	if sc.Resample != "" && (sc.Mean || !validResample(sc.Resample)) {
+		return nil, fmt.Errorf("%s: invalid resample", sc.Column)
+	}
+	s := &stat{name: sc.Column, column: sc.Column, key: sc.Key, id: sc.Id, unit: sc.Unit, mean: sc.Mean, scale: sc.Scale,
+		billingId: sc.BillingId, costId: sc.CostId,
+		compensationId: sc.CompensationId, peakId: sc.PeakId,
+		resample: sc.Resample}
+	if s.scale == 0 {
+		s.scale = 1
+	}
+	if sc.Calibration < 0 {
+		return nil, fmt.Errorf("%s: invalid calibration", sc.Column)
+	}
+	s.calibration = sc.Calibration
+	if sc.Smooth < 0 || (sc.Smooth != 0 && sc.Mean) {
+		return nil, fmt.Errorf("%s: invalid smooth", sc.Column)
+	}
+	s.smooth = sc.Smooth
+	if sc.MaxHourly < 0 || (sc.MaxHourly != 0 && sc.Mean) {
+		return nil, fmt.Errorf("%s: invalid max_hourly", sc.Column)
+	}
+	s.maxHourly = sc.MaxHourly
+	if sc.StateClass != "" {
+		if err := s.setClass(sc.StateClass); err != nil {
+			return nil, fmt.Errorf("%s: %v", sc.Column, err)
+		}
+	}
+	if sc.Final != "" {
+		if sc.Mean {
+			return nil, fmt.Errorf("%s: final reading of a measurement", sc.Column)
+		}
+		var err error
+		if s.final, err = parseFinal(sc.Final); err != nil {
+			return nil, fmt.Errorf("%s: %v", sc.Column, err)
+		}
+	}
+	if s.resample == resampleProfile {
+		name := sc.Profile
+		if name == "" {
+			name = *profileName
+		}
+		var err error
+		if s.profile, err = readProfile(name); err != nil {
+			return nil, fmt.Errorf("%s: %v", sc.Column, err)
+		}
+	}
+	return s, nil
+}
+
+// readMapping reads a mapping file and creates the statistics.
+func readMapping(file string) ([]*stat, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	lines, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var stats []*stat
+	for i, l := range lines {
+		if len(l) < 2 || len(l) > 4 {
+			return nil, fmt.Errorf("%s: %d: expected column,key or statistic_id[,unit[,sum, total or mean]]", file, i+1)
+		}
+		sc := statConfig{Column: l[0]}
+		if k, err := strconv.Atoi(l[1]); err == nil {
+			sc.Key = k
+		} else {
+			sc.Id = l[1]
+		}
+		if len(l) > 2 {
+			sc.Unit = l[2]
+		}
+		if len(l) > 3 {
+			switch strings.ToLower(l[3]) {
+			case "sum":
+			case "total":
+				sc.StateClass = classTotal
+			case "mean":
+				sc.Mean = true
+			default:
+				return nil, fmt.Errorf("%s: %d: %s: expected sum, total or mean", file, i+1, l[3])
+			}
+		}
+		s, err := sc.newStat()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %d: %v", file, i+1, err)
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
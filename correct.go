@@ -0,0 +1,238 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Corrections to the readings: smoothing of noisy counters, calibration
+// factors for meters that read high or low, limits on the usage per hour
+// to guard against corrupt counter jumps, and correction of the accumulated sums to a known meter reading
+// to remove the drift caused by missed samples or rounding in the source.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var imp_final = flag.String("import-final", "", "Known import meter reading, as VALUE@DATE e.g 12345.6@2024-06-30")
+var exp_final = flag.String("export-final", "", "Known export meter reading, as VALUE@DATE")
+var gen_final = flag.String("gen-final", "", "Known solar generation meter reading, as VALUE@DATE")
+var maxHourlyAction = flag.String("max-hourly-action", "clamp", "Action for usage above the -max-hourly limit: clamp or drop")
+var calibrations sensorList
+var smoothing sensorList
+var maxHourly sensorList
+
+func init() {
+	flag.Var(&calibrations, "calibrate", "Calibration factor of a statistic, as NAME=FACTOR e.g import=0.97 (may be repeated)")
+	flag.Var(&smoothing, "smooth", "Smoothing window of a noisy counter, as NAME=READINGS e.g import=5 (may be repeated)")
+	flag.Var(&maxHourly, "max-hourly", "Maximum usage of a statistic in one hour, as NAME=LIMIT e.g import=20 (may be repeated)")
+}
+
+// setMaxHourly applies the -max-hourly flags to the statistics.
+func setMaxHourly(stats []*stat) error {
+	if *maxHourlyAction != "clamp" && *maxHourlyAction != "drop" {
+		return fmt.Errorf("%s: unknown action", *maxHourlyAction)
+	}
+	for _, c := range maxHourly {
+		name, v, _ := strings.Cut(c, "=")
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 {
+			return fmt.Errorf("%s: invalid limit", c)
+		}
+		found := false
+		for _, s := range stats {
+			if s.name == name && !s.mean {
+				s.maxHourly = f
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: unknown statistic", c)
+		}
+	}
+	return nil
+}
+
+// clampUsage limits the usage between samples to the maximum per hour
+// (pro rata for samples more or less than an hour apart). Usage over the
+// limit is either clamped to the limit, or dropped altogether.
+func (s *stat) clampUsage() {
+	var offset float32
+	for i := 1; i < len(s.values); i++ {
+		v := &s.values[i]
+		v.sum -= offset
+		delta := v.sum - s.values[i-1].sum
+		limit := float32(s.maxHourly * v.t.Sub(s.values[i-1].t).Hours())
+		if delta <= limit {
+			continue
+		}
+		excess := delta - limit
+		action := "clamped"
+		if *maxHourlyAction == "drop" {
+			excess = delta
+			action = "dropped"
+		}
+		s.logger().Printf("%s: %s: usage of %f exceeds the limit of %f, %s", s.name, v.t.Format(tFmt), delta, limit, action)
+		v.sum -= excess
+		offset += excess
+	}
+}
+
+// setSmoothing applies the -smooth flags to the statistics.
+func setSmoothing(stats []*stat) error {
+	for _, c := range smoothing {
+		name, v, _ := strings.Cut(c, "=")
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("%s: invalid smoothing window", c)
+		}
+		found := false
+		for _, s := range stats {
+			if s.name == name && !s.mean && s.interval == 0 {
+				s.smooth = n
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: unknown statistic", c)
+		}
+	}
+	return nil
+}
+
+// smoothed returns the moving average of the counter over the smoothing window,
+// and whether the counter has been reset. Since the counter jitters, a reset
+// is only detected when the reading falls below every reading in the window,
+// and otherwise a decrease of the average is ignored.
+func (s *stat) smoothed(val float32) (float32, bool) {
+	reset := len(s.window) != 0
+	for _, w := range s.window {
+		if val >= w {
+			reset = false
+		}
+	}
+	if reset {
+		s.window = s.window[:0]
+	}
+	s.window = append(s.window, val)
+	if len(s.window) > s.smooth {
+		s.window = s.window[1:]
+	}
+	var total float32
+	for _, w := range s.window {
+		total += w
+	}
+	avg := total / float32(len(s.window))
+	if !reset && len(s.values) != 0 && avg < s.last {
+		avg = s.last
+	}
+	return avg, reset
+}
+
+// setCalibration applies the -calibrate flags to the statistics.
+func setCalibration(stats []*stat) error {
+	for _, c := range calibrations {
+		name, v, _ := strings.Cut(c, "=")
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 {
+			return fmt.Errorf("%s: invalid calibration factor", c)
+		}
+		found := false
+		for _, s := range stats {
+			if s.name == name {
+				s.calibration = f
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: unknown statistic", c)
+		}
+	}
+	return nil
+}
+
+// gain returns the calibration factor of the statistic.
+func (s *stat) gain() float32 {
+	if s.calibration == 0 {
+		return 1
+	}
+	return float32(s.calibration)
+}
+
+// A known meter reading.
+type meterReading struct {
+	value float64
+	t     time.Time
+}
+
+// parseFinal parses a meter reading of the form VALUE@DATE, where
+// the date may include a time (a date alone is the start of the day).
+func parseFinal(s string) (*meterReading, error) {
+	v, d, ok := strings.Cut(s, "@")
+	if !ok {
+		return nil, fmt.Errorf("%s: expected VALUE@DATE", s)
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid reading", s)
+	}
+	t, err := parseDate(d)
+	if err != nil {
+		return nil, err
+	}
+	return &meterReading{value: f, t: t}, nil
+}
+
+// parseDate parses a local date, with an optional time
+// (a date alone is the start of the day).
+func parseDate(d string) (time.Time, error) {
+	if t, err := time.ParseInLocation(tFmt, d, csvLoc); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", d, csvLoc)
+	if err != nil {
+		return t, fmt.Errorf("%s: invalid date", d)
+	}
+	return t, nil
+}
+
+// correctDrift scales the sums so that the total consumption between the
+// first reading and the known meter reading matches the meter.
+func (s *stat) correctDrift() {
+	f := s.final
+	if len(s.values) == 0 || !f.t.After(s.values[0].t) {
+		s.logger().Printf("%s: final reading is not after the first sample, ignored", s.name)
+		return
+	}
+	// The sum at the time of the final reading, from the last sample at or before it.
+	var sum float32
+	for _, v := range s.values {
+		if v.t.After(f.t) {
+			break
+		}
+		sum = v.sum
+	}
+	want := f.value*s.scale - float64(s.values[0].value)
+	if sum <= 0 || want <= 0 {
+		s.logger().Printf("%s: no consumption before the final reading, not corrected", s.name)
+		return
+	}
+	k := want / float64(sum)
+	s.logger().Printf("%s: sums scaled by %f to match the final reading", s.name, k)
+	for i := range s.values {
+		s.values[i].sum = float32(float64(s.values[i].sum) * k)
+	}
+}
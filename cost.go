@@ -0,0 +1,151 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Cost statistics, derived from an energy statistic using a tariff,
+// and compensation statistics for exported energy at the feed-in rate.
+// The usage charge for each day is rounded as configured, and a daily
+// supply charge may be added, so that the costs match what was billed.
+// Alternatively, a meter's cumulative cost register may be read directly
+// into a cost statistic.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+var currency = flag.String("currency", "USD", "Currency of the cost statistics")
+var rate = flag.Float64("rate", 0, "Energy rate per kWh for cost statistics")
+var supplyCharge = flag.Float64("supply-charge", 0, "Daily supply charge added to cost statistics")
+var costRound = flag.Float64("cost-round", 0, "Round each day's usage charge to a multiple of this amount e.g 0.01")
+var costRounding = flag.String("cost-rounding", "nearest", "Rounding of the daily usage charge: nearest, up or down")
+var feedInRate = flag.Float64("feed-in-rate", 0, "Feed-in rate per kWh for compensation statistics")
+var costs sensorList
+var compensations sensorList
+var costColumns sensorList
+
+func init() {
+	flag.Var(&costs, "cost", "Cost statistic for a statistic, as NAME=STATISTIC_ID e.g import=sensor.import_cost (may be repeated)")
+	flag.Var(&compensations, "compensation", "Compensation statistic for exported energy, as NAME=STATISTIC_ID e.g export=sensor.export_compensation (may be repeated)")
+	flag.Var(&costColumns, "cost-column", "Cumulative cost column read as a cost statistic in -currency, as COLUMN=STATISTIC_ID e.g COST=sensor.import_cost (may be repeated)")
+}
+
+// parseCostColumn creates a cost statistic from a -cost-column flag value.
+// The column is a cumulative register, so it is read as an accumulating meter.
+func parseCostColumn(v string) (*stat, error) {
+	col, id, found := strings.Cut(v, "=")
+	if !found || col == "" {
+		return nil, fmt.Errorf("%s: expected COLUMN=STATISTIC_ID", v)
+	}
+	if !statIdRe.MatchString(id) {
+		return nil, fmt.Errorf("%s: invalid statistic_id", id)
+	}
+	return &stat{name: id, column: col, id: id, unit: *currency, scale: 1}, nil
+}
+
+// setCosts applies the -cost and -compensation flags to the statistics.
+func setCosts(stats []*stat) error {
+	if err := setDerived(stats, costs, func(s *stat, id string) { s.costId = id }); err != nil {
+		return err
+	}
+	return setDerived(stats, compensations, func(s *stat, id string) { s.compensationId = id })
+}
+
+// setDerived sets the statistic_id of a derived statistic from a list of NAME=STATISTIC_ID.
+func setDerived(stats []*stat, list sensorList, set func(*stat, string)) error {
+	for _, c := range list {
+		name, id, _ := strings.Cut(c, "=")
+		if !statIdRe.MatchString(id) {
+			return fmt.Errorf("%s: invalid statistic_id", c)
+		}
+		found := false
+		for _, s := range stats {
+			if s.name == name && !s.mean {
+				set(s, id)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: unknown statistic", c)
+		}
+	}
+	return nil
+}
+
+// roundCharge rounds a charge according to the rounding flags.
+func roundCharge(c float64) float64 {
+	if *costRound <= 0 {
+		return c
+	}
+	n := c / *costRound
+	switch *costRounding {
+	case "up":
+		n = math.Ceil(n)
+	case "down":
+		n = math.Floor(n)
+	default:
+		n = math.Round(n)
+	}
+	return n * *costRound
+}
+
+// costStat returns a new statistic derived from this one, with
+// the sum being the accumulated cost of the energy at the given rate,
+// plus the daily supply charge.
+func (s *stat) costStat(id string, rate, supply float64) (*stat, error) {
+	switch *costRounding {
+	case "nearest", "up", "down":
+	default:
+		return nil, fmt.Errorf("%s: unknown cost rounding", *costRounding)
+	}
+	c := &stat{name: id, column: s.column, id: id, unit: *currency, scale: 1}
+	if db != nil {
+		var err error
+		if c.key, err = lookupKey(db, c.id); err != nil {
+			return nil, fmt.Errorf("%s: %v", c.id, err)
+		}
+	}
+	// Rates are per kWh.
+	toKWh := 1.0
+	if f, ok := convert(s.unit, "kWh"); ok {
+		toKWh = f
+	}
+	var day time.Time
+	var total, dayEnergy, prev float64
+	for i, v := range s.values {
+		sum := float64(v.sum) * toKWh
+		// The period ending at the sample time determines the day.
+		y, m, d := v.t.Add(-time.Nanosecond).Date()
+		if vd := time.Date(y, m, d, 0, 0, 0, 0, v.t.Location()); i == 0 || !vd.Equal(day) {
+			// Complete the previous day's charge, and start the new day.
+			total += roundCharge(dayEnergy * rate)
+			dayEnergy = 0
+			day = vd
+			if i != 0 {
+				total += supply
+			}
+		}
+		if i != 0 {
+			dayEnergy += sum - prev
+		}
+		prev = sum
+		cost := float32(total + dayEnergy*rate)
+		c.values = append(c.values, sample{t: v.t, sum: cost, value: cost, reset: s.values[0].t})
+	}
+	return c, nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Handling of the current CSV file, which is still being written.
+// Its last hour is incomplete, and the partial hour's records would
+// later conflict with the final data, so the file may be skipped or
+// read only up to the last complete hour.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+)
+
+var current = flag.String("current", currentRead, "Handling of the current file that is still being written: read, skip, or complete (only up to the last complete hour)")
+
+// Handling of the current file
+const currentRead = "read"         // The file is read as usual (and re-read on the next run)
+const currentSkip = "skip"         // The file is skipped
+const currentComplete = "complete" // Only the rows up to the last complete hour are read
+
+// A file modified more recently than this is still being written.
+const currentAge = time.Hour
+
+// currentLimit returns whether the file is current and should be skipped,
+// or the time of the last row to be read from it (zero if there is no limit).
+func currentLimit(info os.FileInfo) (bool, time.Time) {
+	if *current == currentRead || time.Since(info.ModTime()) >= currentAge {
+		return false, time.Time{}
+	}
+	if *current == currentSkip {
+		return true, time.Time{}
+	}
+	now := time.Now().In(csvLoc)
+	return false, time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, csvLoc)
+}
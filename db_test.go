@@ -0,0 +1,62 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// Tables prefixed by a database are looked up in that database.
+func TestCheckColumnsPrefix(t *testing.T) {
+	dir := t.TempDir()
+	d, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, "main.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// The attached database is only attached to one connection.
+	d.SetMaxOpenConns(1)
+	for _, q := range []string{
+		"CREATE TABLE statistics (id INTEGER, start_ts FLOAT)",
+		"ATTACH DATABASE '" + filepath.Join(dir, "other.db") + "' AS other",
+		"CREATE TABLE other.statistics (id INTEGER, start DATETIME)",
+	} {
+		if _, err := d.Exec(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	tests := []struct {
+		table   string
+		col     string
+		ok      bool
+		noTable bool
+	}{
+		{"statistics", "start_ts", true, false},
+		{"statistics", "start", false, false},
+		{"other.statistics", "start", true, false},
+		{"other.statistics", "start_ts", false, false},
+		{"other.statistics_meta", "id", false, true},
+		{"missing", "id", false, true},
+	}
+	for _, tc := range tests {
+		err := checkColumns(d, tc.table, []string{tc.col})
+		if (err == nil) != tc.ok || errors.Is(err, errNoTable) != tc.noTable {
+			t.Errorf("%s.%s: error %v, expected found %v, table missing %v", tc.table, tc.col, err, tc.ok, tc.noTable)
+		}
+	}
+}
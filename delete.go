@@ -0,0 +1,79 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Removal of the existing records. A single DELETE of years of records
+// may lock the table long enough to stall the recorder of a running
+// Home Assistant, so the DELETE may be split into chunks of time.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+)
+
+var deleteChunk = flag.String("delete-chunk", "", "Split the DELETE of the existing records into chunks: day, week or month")
+
+// checkDeleteChunk validates the -delete-chunk size.
+func checkDeleteChunk() error {
+	switch *deleteChunk {
+	case "":
+		return nil
+	case "day", "week", "month":
+		// Within a single transaction, the locks are held until the end,
+		// so the chunks would make no difference.
+		if *transaction {
+			return errors.New("-delete-chunk requires -transaction=false")
+		}
+		return nil
+	}
+	return fmt.Errorf("%s: unknown -delete-chunk size", *deleteChunk)
+}
+
+// nextChunk returns the start of the chunk after the one containing t (UTC).
+func nextChunk(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch *deleteChunk {
+	case "week":
+		return day.AddDate(0, 0, 7-int(day.Weekday()))
+	case "month":
+		return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return day.AddDate(0, 0, 1)
+}
+
+// deleteSQL generates the SQL to remove the existing records within the span.
+// When chunked, the records are removed one chunk at a time across the period
+// of the new records, with one DELETE each for any records before and after them.
+func deleteSQL(table, key string, sp span, recs []record) {
+	table = quoteIdent(table)
+	id, start := quoteIdent("metadata_id"), quoteIdent(startCol())
+	if *deleteChunk == "" || len(recs) == 0 {
+		fmt.Fprintf(deleteOut(), "DELETE FROM %s WHERE %s = %s%s;\n", table, id, key, sp.where())
+		return
+	}
+	first, last := recs[0].start, recs[len(recs)-1].start
+	where := func(cond string, a ...interface{}) {
+		fmt.Fprintf(deleteOut(), "DELETE FROM %s WHERE %s = %s%s AND %s;\n", table, id, key, sp.where(), fmt.Sprintf(cond, a...))
+	}
+	where("%s < %s", start, timeValue(first))
+	for from := first; !from.After(last); {
+		to := nextChunk(from)
+		where("%s >= %s AND %s < %s", start, timeValue(from), start, timeValue(to))
+		from = to
+	}
+	where("%s >= %s", start, timeValue(nextChunk(last)))
+}
@@ -0,0 +1,96 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Peak demand statistics, derived from an energy statistic. The demand
+// is the average power over each demand window, and the statistic
+// holds the peak demand so far in the day or month, as used by demand tariffs.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+var demandWindow = flag.Duration("demand-window", time.Minute*30, "Window over which the demand is measured")
+var peakPeriod = flag.String("peak-period", "month", "Period of peak demand statistics: day or month")
+var peakDemand sensorList
+
+func init() {
+	flag.Var(&peakDemand, "peak-demand", "Peak demand statistic for a statistic, as NAME=STATISTIC_ID e.g import=sensor.import_peak_demand (may be repeated)")
+}
+
+// setPeakDemand applies the -peak-demand flags to the statistics.
+func setPeakDemand(stats []*stat) error {
+	return setDerived(stats, peakDemand, func(s *stat, id string) { s.peakId = id })
+}
+
+// peakStart returns the start of the day or month that the period ending at t belongs to.
+func peakStart(t time.Time, period string) time.Time {
+	y, m, d := t.Add(-time.Nanosecond).Date()
+	if period == "month" {
+		d = 1
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// peakDemandStat returns a new statistic derived from this one, with the value
+// being the peak demand (in kW) since the start of the day or month.
+// Only samples at the end of each demand window are used, so the
+// source data must be at least as frequent as the window.
+func (s *stat) peakDemandStat(window time.Duration, period string) (*stat, error) {
+	if period != "day" && period != "month" {
+		return nil, fmt.Errorf("%s: unknown peak period", period)
+	}
+	if window <= 0 || time.Hour%window != 0 {
+		return nil, fmt.Errorf("%s: demand window must divide an hour", window)
+	}
+	p := &stat{name: s.peakId, column: s.column, id: s.peakId, unit: "kW", mean: true, scale: 1}
+	if db != nil {
+		var err error
+		if p.key, err = lookupKey(db, p.id); err != nil {
+			return nil, fmt.Errorf("%s: %v", p.id, err)
+		}
+	}
+	toKWh := 1.0
+	if f, ok := convert(s.unit, "kWh"); ok {
+		toKWh = f
+	}
+	var start, prevT time.Time
+	var prevSum float32
+	var peak float64
+	for _, v := range s.values {
+		if !v.t.Truncate(window).Equal(v.t) {
+			continue
+		}
+		// Demand can only be measured over a complete window.
+		if !prevT.IsZero() && v.t.Sub(prevT) == window {
+			if ps := peakStart(v.t, period); !ps.Equal(start) {
+				start = ps
+				peak = 0
+			}
+			if d := float64(v.sum-prevSum) * toKWh / window.Hours(); d > peak {
+				peak = d
+			}
+			p.values = append(p.values, sample{t: v.t, value: float32(peak)})
+		}
+		prevT = v.t
+		prevSum = v.sum
+	}
+	if len(p.values) == 0 {
+		s.logger().Printf("%s: no complete %s windows, peak demand not generated", s.name, window)
+	}
+	return p, nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Demo mode, which runs the pipeline against a small embedded example
+// dataset (two days of MeterMan import, export and generation readings),
+// so that the output can be seen before using real data.
+
+package main
+
+import (
+	"embed"
+	"flag"
+	"os"
+	"path/filepath"
+)
+
+var demo = flag.Bool("demo", false, "Run against a built-in example dataset instead of -dir")
+
+//go:embed demo/*.csv
+var demoFiles embed.FS
+
+// demoDir extracts the example dataset to a temporary directory,
+// which the caller removes.
+func demoDir() (string, error) {
+	dir, err := os.MkdirTemp("", "ha-backfill-demo")
+	if err != nil {
+		return "", err
+	}
+	files, err := demoFiles.ReadDir("demo")
+	if err != nil {
+		return dir, err
+	}
+	for _, f := range files {
+		data, err := demoFiles.ReadFile("demo/" + f.Name())
+		if err != nil {
+			return dir, err
+		}
+		if err := os.WriteFile(filepath.Join(dir, f.Name()), data, 0644); err != nil {
+			return dir, err
+		}
+	}
+	return dir, nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Column detection, which inspects the CSV files and proposes
+// a mapping file for the columns found.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+var detect = flag.Bool("detect", false, "Inspect the CSV files and propose a column mapping")
+
+// Maximum number of files inspected when detecting columns.
+const detectFiles = 5
+
+// Characters not allowed in a statistic_id
+var idCleanRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Analysis of the values in one column.
+type colInfo struct {
+	header    string
+	count     int     // Number of numeric values
+	other     int     // Number of non-numeric values
+	decreases int     // Number of times the value went down
+	min, max  float64 // Range of values
+	last      float64 // Previous value
+}
+
+// detectColumns inspects the files and writes a proposed mapping file to stdout.
+// If stdin is a terminal, the user is prompted for the statistic of each column.
+func detectColumns(files []string) error {
+	var cols []*colInfo
+	var header []string
+	n := 0
+	for _, file := range files {
+		if n >= detectFiles {
+			break
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		var r [][]string
+		cr, _, err := csvReader(f)
+		if err == nil {
+			r, err = cr.ReadAll()
+		}
+		f.Close()
+		first := 1
+		if err == nil && len(r) > 1 && addUnits(r[0], r[1]) {
+			first = 2
+		}
+		if err != nil || len(r) <= first {
+			continue
+		}
+		n++
+		if header == nil {
+			header = r[0]
+			for _, h := range header {
+				cols = append(cols, &colInfo{header: h})
+			}
+		}
+		for _, data := range r[first:] {
+			if len(data) != len(header) {
+				continue
+			}
+			for i, v := range data {
+				cols[i].add(v)
+			}
+		}
+	}
+	if header == nil {
+		return fmt.Errorf("no CSV files with data found")
+	}
+	interactive := term.IsTerminal(int(os.Stdin.Fd()))
+	in := bufio.NewReader(os.Stdin)
+	fmt.Println("# column,key or statistic_id,unit,sum or mean")
+	for _, c := range cols {
+		switch {
+		case matchHeader(h_date, c.header) || matchHeader(h_time, c.header):
+			fmt.Fprintf(os.Stderr, "%s: date/time column\n", c.header)
+			continue
+		case c.count == 0 || c.other > c.count:
+			fmt.Fprintf(os.Stderr, "%s: not numeric, skipped\n", c.header)
+			continue
+		}
+		kind, unit := c.propose()
+		fmt.Fprintf(os.Stderr, "%s: %d values, range %g to %g, %d decreases: proposed %s", c.header, c.count, c.min, c.max, c.decreases, kind)
+		if unit != "" {
+			fmt.Fprintf(os.Stderr, " (%s)", unit)
+		}
+		fmt.Fprintln(os.Stderr)
+		id := "sensor." + strings.Trim(idCleanRe.ReplaceAllString(strings.ToLower(c.header), "_"), "_")
+		if interactive {
+			fmt.Fprintf(os.Stderr, "  key or statistic_id for %s (- to skip) [%s]: ", c.header, id)
+			line, _ := in.ReadString('\n')
+			line = strings.TrimSpace(line)
+			if line == "-" {
+				continue
+			}
+			if line != "" {
+				id = line
+			}
+		}
+		fmt.Printf("%s,%s,%s,%s\n", c.header, id, unit, kind)
+	}
+	return nil
+}
+
+// add analyses one value of the column.
+func (c *colInfo) add(s string) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		c.other++
+		return
+	}
+	if c.count == 0 {
+		c.min, c.max = v, v
+	} else {
+		if v < c.last {
+			c.decreases++
+		}
+		if v < c.min {
+			c.min = v
+		}
+		if v > c.max {
+			c.max = v
+		}
+	}
+	c.last = v
+	c.count++
+}
+
+// propose returns the proposed kind of statistic and the unit.
+// A counter that rarely decreases is assumed to be an accumulating meter.
+func (c *colInfo) propose() (string, string) {
+	kind := "mean"
+	if c.count > 1 && c.max > c.min && c.decreases*100 <= c.count {
+		kind = "sum"
+	}
+	unit := ""
+	if _, u := splitUnit(c.header); u != "" {
+		unit = u
+	} else if kind == "sum" {
+		// Meters without a unit are most likely energy.
+		unit = "kWh"
+	}
+	return kind, unit
+}
@@ -0,0 +1,125 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// SQL dialect of the generated SQL. The identifiers are quoted as the
+// database expects, and the session settings that the SQL relies on
+// are set at the start, so that the SQL can be applied as is.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var sqlDialect = flag.String("dialect", "", "SQL dialect of the generated SQL: sqlite, mysql or postgresql (by default, that of the database, otherwise sqlite)")
+
+// selectDialect validates the -dialect flag against the database, if there is one.
+func selectDialect() error {
+	switch *sqlDialect {
+	case "":
+		return nil
+	case dialectSQLite, dialectMySQL, dialectPostgres:
+	default:
+		return fmt.Errorf("%s: unknown SQL dialect", *sqlDialect)
+	}
+	if db != nil && dialect != *sqlDialect {
+		return fmt.Errorf("-dialect %s does not match the %s database", *sqlDialect, dialect)
+	}
+	dialect = *sqlDialect
+	return nil
+}
+
+// quoteIdent returns the quoted identifier, including any database prefix.
+// Any quote characters within the identifier are doubled.
+func quoteIdent(name string) string {
+	q := `"`
+	if dialect == dialectMySQL {
+		q = "`"
+	}
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = q + strings.ReplaceAll(p, q, q+q) + q
+	}
+	return strings.Join(parts, ".")
+}
+
+// quoteIdents returns the comma separated list of quoted identifiers.
+func quoteIdents(names ...string) string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = quoteIdent(n)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// tempTable returns the keywords to create a temporary table.
+// MySQL's temporary tables do not implicitly commit the transaction.
+func tempTable() string {
+	if dialect == dialectMySQL {
+		return "TEMPORARY TABLE"
+	}
+	return "TEMP TABLE"
+}
+
+// dropTemp returns the keywords to drop a temporary table.
+func dropTemp() string {
+	if dialect == dialectMySQL {
+		return "TEMPORARY TABLE"
+	}
+	return "TABLE"
+}
+
+// fromDual returns the FROM clause needed by a SELECT of values only
+// that has a WHERE clause.
+func fromDual() string {
+	if dialect == dialectMySQL {
+		return " FROM DUAL"
+	}
+	return ""
+}
+
+// boolSQL returns the SQL for a boolean value. PostgreSQL does not
+// accept integers for boolean columns.
+func boolSQL(b bool) string {
+	switch {
+	case dialect == dialectPostgres && b:
+		return "TRUE"
+	case dialect == dialectPostgres:
+		return "FALSE"
+	case b:
+		return "1"
+	}
+	return "0"
+}
+
+// sessionSQL generates the statements that set up the session for the generated SQL.
+func sessionSQL() {
+	switch dialect {
+	case dialectSQLite:
+		fmt.Fprintln(sqlOut, "PRAGMA foreign_keys = ON;")
+	case dialectMySQL:
+		// String literals only escape quotes, by doubling them.
+		fmt.Fprintln(sqlOut, "SET NAMES utf8mb4;")
+		fmt.Fprintln(sqlOut, "SET SESSION sql_mode = CONCAT_WS(',', NULLIF(@@SESSION.sql_mode, ''), 'NO_BACKSLASH_ESCAPES');")
+		fmt.Fprintln(sqlOut, "SET SESSION foreign_key_checks = 1;")
+		// The times are UTC, as stored by Home Assistant.
+		fmt.Fprintln(sqlOut, "SET SESSION time_zone = '+00:00';")
+	case dialectPostgres:
+		fmt.Fprintln(sqlOut, "SET client_encoding = 'UTF8';")
+		fmt.Fprintln(sqlOut, "SET standard_conforming_strings = on;")
+		fmt.Fprintln(sqlOut, "SET TIME ZONE 'UTC';")
+	}
+}
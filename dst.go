@@ -0,0 +1,83 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Handling of local times around daylight saving transitions.
+// When the clocks go forward, the skipped local times do not exist,
+// and when the clocks go back, the repeated local times are ambiguous.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+var dstGap = flag.String("dst-gap", dstSkip, "Handling of nonexistent local times when the clocks go forward: skip or shift")
+
+// Handling of nonexistent local times
+const dstSkip = "skip"   // The reading is skipped with a warning
+const dstShift = "shift" // The time is shifted forward by the length of the gap
+
+// Offsets from a local time at which a repeated local time may occur, earliest first.
+var dstOccurs = [...]time.Duration{-time.Hour, -time.Minute * 30, 0, time.Minute * 30, time.Hour}
+
+// parseLocal parses a local date and time of day in the location. Nonexistent
+// times are skipped (returning an error) or shifted forward, using the offset
+// in effect before the clocks went forward. A repeated time is taken as the
+// first occurrence that is after the previous reading.
+// The date and time are parsed separately, and compared without formatting,
+// as this is called for every row.
+func parseLocal(date, clock string, loc *time.Location, prev time.Time) (time.Time, error) {
+	d, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return time.Time{}, err
+	}
+	c, err := time.Parse("15:04", clock)
+	if err != nil {
+		return time.Time{}, err
+	}
+	w := time.Date(d.Year(), d.Month(), d.Day(), c.Hour(), c.Minute(), 0, 0, time.UTC)
+	tm := time.Date(d.Year(), d.Month(), d.Day(), c.Hour(), c.Minute(), 0, 0, loc)
+	if !sameWall(tm, w) {
+		if *dstGap != dstShift {
+			return time.Time{}, fmt.Errorf("nonexistent local time (%s %s), skipped", date, clock)
+		}
+		// Use the offset of the day before, which precedes the transition.
+		_, off := tm.AddDate(0, 0, -1).Zone()
+		return time.Unix(w.Unix()-int64(off), 0).In(loc), nil
+	}
+	// Find the occurrences of a repeated time, earliest first.
+	var occurs [len(dstOccurs)]time.Time
+	n := 0
+	for _, off := range dstOccurs {
+		if o := tm.Add(off); sameWall(o, w) {
+			occurs[n] = o
+			n++
+		}
+	}
+	for _, o := range occurs[:n] {
+		if o.After(prev) {
+			return o, nil
+		}
+	}
+	return occurs[0], nil
+}
+
+// sameWall returns true if the local time has the same date, hour and minute as w.
+func sameWall(t, w time.Time) bool {
+	y, m, d := t.Date()
+	wy, wm, wd := w.Date()
+	return y == wy && m == wm && d == wd && t.Hour() == w.Hour() && t.Minute() == w.Minute()
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+// In Sydney, the clocks went back from 03:00 AEDT (+11) to 02:00 AEST (+10)
+// on 2023-04-02, and forward from 02:00 AEST to 03:00 AEDT on 2023-10-01.
+func TestParseLocal(t *testing.T) {
+	loc, err := time.LoadLocation("Australia/Sydney")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utc := func(s string) time.Time {
+		tm, err := time.Parse(tFmt, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		name  string
+		date  string
+		clock string
+		gap   string
+		prev  time.Time
+		want  time.Time // zero if the time is skipped
+	}{
+		{"standard time", "2023-06-01", "12:00", dstSkip, time.Time{}, utc("2023-06-01 02:00")},
+		{"daylight time", "2023-12-01", "12:00", dstSkip, time.Time{}, utc("2023-12-01 01:00")},
+		{"before spring forward", "2023-10-01", "01:55", dstSkip, time.Time{}, utc("2023-09-30 15:55")},
+		{"spring forward skipped", "2023-10-01", "02:00", dstSkip, time.Time{}, time.Time{}},
+		{"spring forward skipped in gap", "2023-10-01", "02:30", dstSkip, time.Time{}, time.Time{}},
+		{"spring forward shifted", "2023-10-01", "02:30", dstShift, time.Time{}, utc("2023-09-30 16:30")},
+		{"after spring forward", "2023-10-01", "03:00", dstSkip, time.Time{}, utc("2023-09-30 16:00")},
+		{"first of repeated hour", "2023-04-02", "02:00", dstSkip, utc("2023-04-01 14:55"), utc("2023-04-01 15:00")},
+		{"first of repeated hour, no previous", "2023-04-02", "02:30", dstSkip, time.Time{}, utc("2023-04-01 15:30")},
+		{"second of repeated hour", "2023-04-02", "02:00", dstSkip, utc("2023-04-01 15:55"), utc("2023-04-01 16:00")},
+		{"second of repeated hour, later", "2023-04-02", "02:30", dstSkip, utc("2023-04-01 16:25"), utc("2023-04-01 16:30")},
+		{"after repeated hour", "2023-04-02", "03:00", dstSkip, utc("2023-04-01 16:55"), utc("2023-04-01 17:00")},
+	}
+	saved := *dstGap
+	defer func() { *dstGap = saved }()
+	for _, tc := range tests {
+		*dstGap = tc.gap
+		got, err := parseLocal(tc.date, tc.clock, loc, tc.prev)
+		if tc.want.IsZero() {
+			if err == nil {
+				t.Errorf("%s: %s %s: got %s, expected an error", tc.name, tc.date, tc.clock, got.UTC().Format(tFmt))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s %s: %v", tc.name, tc.date, tc.clock, err)
+			continue
+		}
+		if !got.Equal(tc.want) {
+			t.Errorf("%s: %s %s: got %s UTC, expected %s UTC", tc.name, tc.date, tc.clock,
+				got.UTC().Format(tFmt), tc.want.Format(tFmt))
+		}
+	}
+}
+
+// The readings of the repeated hour are kept in order when read in sequence.
+func TestParseLocalRepeatedHour(t *testing.T) {
+	loc, err := time.LoadLocation("Australia/Sydney")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clocks := []string{"01:30", "02:00", "02:30", "02:00", "02:30", "03:00"}
+	var prev time.Time
+	for _, c := range clocks {
+		tm, err := parseLocal("2023-04-02", c, loc, prev)
+		if err != nil {
+			t.Fatalf("%s: %v", c, err)
+		}
+		if !prev.IsZero() && tm.Sub(prev) != time.Minute*30 {
+			t.Errorf("%s: %s is %s after the previous reading, expected 30m", c, tm.UTC().Format(tFmt), tm.Sub(prev))
+		}
+		prev = tm
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Support for the recorder schema of Home Assistant 2023.4 and later,
+// in which the times of the statistics are the created_ts, start_ts
+// and last_reset_ts columns, holding seconds since the epoch, rather
+// than the created, start and last_reset datetime columns.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// startCol returns the column of the start time of the statistics records.
+func startCol() string {
+	if *schema == schemaEpoch {
+		return "start_ts"
+	}
+	return "start"
+}
+
+// createdCol returns the column of the time the statistics records were created.
+func createdCol() string {
+	if *schema == schemaEpoch {
+		return "created_ts"
+	}
+	return "created"
+}
+
+// lastResetCol returns the column of the time the sum of the statistics records was last reset.
+func lastResetCol() string {
+	if *schema == schemaEpoch {
+		return "last_reset_ts"
+	}
+	return "last_reset"
+}
+
+// recordColumns returns the columns of the statistics records for the schema.
+// The last reset is only written with the legacy schema, but is kept with the
+// epoch schema, where it is set for statistics with a last reset.
+func recordColumns() []string {
+	cols := []string{createdCol(), startCol(), "mean", "min", "max", "state", "sum", "metadata_id"}
+	if *schema == schemaLegacy || *schema == schemaEpoch {
+		cols = append(cols, lastResetCol())
+	}
+	return cols
+}
+
+// timeValue returns the SQL literal of the time in a time column of the schema.
+func timeValue(t time.Time) string {
+	if *schema == schemaEpoch {
+		return strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', -1, 64)
+	}
+	return "'" + t.In(time.UTC).Format(dbTimeFmt) + "'"
+}
+
+// detectSchema selects the epoch schema if the statistics tables have
+// the start_ts column, returning true if it is selected.
+func detectSchema(d *sql.DB) bool {
+	if checkColumns(d, longName(), []string{"start_ts"}) != nil {
+		return false
+	}
+	*schema = schemaEpoch
+	return true
+}
+
+// epochSQL returns the SQL to format a column of seconds since the epoch as dbTimeFmt.
+func epochSQL(col string) string {
+	switch dialect {
+	case dialectMySQL:
+		// The session time zone is UTC.
+		return fmt.Sprintf("DATE_FORMAT(FROM_UNIXTIME(%s), '%%Y-%%m-%%d %%H:%%i:%%s')", col)
+	case dialectPostgres:
+		return fmt.Sprintf("to_char(to_timestamp(%s) AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')", col)
+	}
+	return fmt.Sprintf("strftime('%%Y-%%m-%%d %%H:%%M:%%S', %s, 'unixepoch')", col)
+}
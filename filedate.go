@@ -0,0 +1,163 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Ordering of the CSV files by the date in their names, for archives
+// whose names do not sort in time order e.g meter_7-Jan-2023.csv,
+// or dates that are not zero padded. The date may also be used to
+// restrict the files that are read to a range of dates, in which case
+// year and month subdirectories (e.g 2023/01/2023-01-15.csv) outside
+// the range are skipped without being walked.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var filenameDate = flag.String("filename-date", "", "Layout of the date in the CSV file names e.g '2-Jan-2006', used to read the files in date order")
+var filenameRegex = flag.String("filename-regex", `\d+[-_.]?[A-Za-z\d]+[-_.]?\d+`, "Regular expression matching the date in the CSV file names (the first group, if present, is the date)")
+var filesFrom = flag.String("files-from", "", "Only read the CSV files dated on or after this date (from the file name)")
+var filesTo = flag.String("files-to", "", "Only read the CSV files dated on or before this date (from the file name)")
+
+// Default layout of the date in the file names.
+const defaultFilenameDate = "2006-01-02"
+
+// Names of year and month subdirectories e.g 2023/01, 2023/1 or 2023-01.
+var yearDir = regexp.MustCompile(`^\d{4}$`)
+var monthDir = regexp.MustCompile(`^\d{1,2}$`)
+var yearMonthDir = regexp.MustCompile(`^(\d{4})[-_](\d{1,2})$`)
+
+// Set up by setupFileDates if the file names are dated.
+var fileDateRe *regexp.Regexp
+var fileDateFrom, fileDateTo time.Time
+
+// setupFileDates validates the file date flags. The file names are dated
+// if a layout or a range is set.
+func setupFileDates() error {
+	if *filenameDate == "" && *filesFrom == "" && *filesTo == "" {
+		return nil
+	}
+	if *filenameDate == "" {
+		*filenameDate = defaultFilenameDate
+	}
+	var err error
+	if fileDateRe, err = regexp.Compile(*filenameRegex); err != nil {
+		return fmt.Errorf("-filename-regex: %v", err)
+	}
+	if *filesFrom != "" {
+		if fileDateFrom, err = parseDate(*filesFrom); err != nil {
+			return fmt.Errorf("-files-from: %v", err)
+		}
+	}
+	if *filesTo != "" {
+		if fileDateTo, err = parseDate(*filesTo); err != nil {
+			return fmt.Errorf("-files-to: %v", err)
+		}
+	}
+	return nil
+}
+
+// fileDate extracts the date from the file's name. Each match of the
+// regular expression is tried in turn until one parses using the layout.
+func fileDate(file string) (time.Time, bool) {
+	for _, m := range fileDateRe.FindAllStringSubmatch(filepath.Base(file), -1) {
+		d := m[0]
+		if len(m) > 1 {
+			d = m[1]
+		}
+		if t, err := time.ParseInLocation(*filenameDate, d, csvLoc); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// orderFiles sorts the files by the date in their names, keeping
+// the name order for files of the same date. Files without a date, or
+// dated outside the -files-from and -files-to range, are dropped.
+func orderFiles(logger *log.Logger, files []string) []string {
+	var dated []string
+	dates := make(map[string]time.Time)
+	for _, f := range files {
+		t, ok := fileDate(f)
+		if !ok {
+			logger.Printf("%s: no date in the file name, skipped", f)
+			continue
+		}
+		if (!fileDateFrom.IsZero() && t.Before(fileDateFrom)) || (!fileDateTo.IsZero() && t.After(fileDateTo)) {
+			continue
+		}
+		dates[f] = t
+		dated = append(dated, f)
+	}
+	sort.SliceStable(dated, func(i, k int) bool {
+		return dates[dated[i]].Before(dates[dated[k]])
+	})
+	return dated
+}
+
+// outsideRange returns true if the file's date, or the year or month
+// of the directory, is outside the -files-from and -files-to range.
+func outsideRange(path string, dir bool) bool {
+	if fileDateFrom.IsZero() && fileDateTo.IsZero() {
+		return false
+	}
+	var start, end time.Time
+	if dir {
+		var ok bool
+		if start, end, ok = dirDates(path); !ok {
+			return false
+		}
+	} else {
+		t, ok := fileDate(path)
+		if !ok {
+			return false
+		}
+		start, end = t, t.Add(time.Nanosecond)
+	}
+	return (!fileDateFrom.IsZero() && !end.After(fileDateFrom)) || (!fileDateTo.IsZero() && start.After(fileDateTo))
+}
+
+// dirDates returns the start and end of the year or month that a
+// directory is named for. A month directory must be within a year directory.
+func dirDates(path string) (time.Time, time.Time, bool) {
+	name := filepath.Base(path)
+	if yearDir.MatchString(name) {
+		y, _ := strconv.Atoi(name)
+		start := time.Date(y, time.January, 1, 0, 0, 0, 0, csvLoc)
+		return start, start.AddDate(1, 0, 0), true
+	}
+	year, month := "", name
+	if m := yearMonthDir.FindStringSubmatch(name); m != nil {
+		year, month = m[1], m[2]
+	} else if parent := filepath.Base(filepath.Dir(path)); yearDir.MatchString(parent) && monthDir.MatchString(name) {
+		year = parent
+	} else {
+		return time.Time{}, time.Time{}, false
+	}
+	y, _ := strconv.Atoi(year)
+	m, _ := strconv.Atoi(month)
+	if m < 1 || m > 12 {
+		return time.Time{}, time.Time{}, false
+	}
+	start := time.Date(y, time.Month(m), 1, 0, 0, 0, 0, csvLoc)
+	return start, start.AddDate(0, 1, 0), true
+}
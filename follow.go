@@ -0,0 +1,199 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Follow mode, which runs continuously, tailing the active (newest) CSV
+// file of each job and importing the hourly statistics via the
+// Home Assistant API as each hour is completed. This provides near
+// real-time statistics for sensors that Home Assistant isn't recording directly.
+// The sums continue on from the latest statistics in Home Assistant.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+var follow = flag.Bool("follow", false, "Run continuously, importing the hourly statistics of the active CSV file via the API as they appear")
+var followInterval = flag.Duration("follow-interval", time.Minute, "How often the active CSV file is checked in -follow mode")
+
+// State of a job's active file.
+type tail struct {
+	file   string // Active file
+	start  int64  // Offset of the data after the header, and any preamble and units, or 0 if not yet found
+	offset int64  // Offset of the next unread line
+}
+
+// State of a statistic's imported records.
+type imported struct {
+	init   bool      // The reference sum has been set
+	latest time.Time // Start of the latest record in Home Assistant
+	sum    float64   // Sum of the latest record in Home Assistant
+	ref    float32   // Sum of the samples at the latest record
+}
+
+// runFollow follows the jobs' active files until the process is stopped.
+// Only the statistics selected via -only and -exclude are imported.
+func runFollow(jobs []*job) {
+	for _, j := range jobs {
+		for _, s := range j.stats {
+			if isSelected(s.name) && s.id == "" {
+				log.Fatalf("%s: statistic_id required for API access", s.name)
+			}
+		}
+	}
+	var err error
+	if api, err = dialHA(*haURL, *haToken); err != nil {
+		log.Fatalf("%s: %v", *haURL, err)
+	}
+	defer api.Close()
+	tails := make(map[*job]*tail)
+	state := make(map[*stat]*imported)
+	for _, j := range jobs {
+		tails[j] = &tail{}
+		for _, s := range j.stats {
+			if !isSelected(s.name) {
+				continue
+			}
+			st := &imported{}
+			if st.latest, st.sum, _, err = api.latest(s.id); err != nil {
+				log.Fatalf("%s: %v", s.id, err)
+			}
+			state[s] = st
+		}
+	}
+	for {
+		for _, j := range jobs {
+			if err := tails[j].read(j); err != nil {
+				log.Printf("%s: %v", j.name, err)
+				continue
+			}
+			for _, s := range j.stats {
+				if state[s] == nil {
+					continue
+				}
+				if err := state[s].push(s); err != nil {
+					log.Printf("%s: %v", s.id, err)
+				}
+			}
+		}
+		time.Sleep(*followInterval)
+	}
+}
+
+// read reads the lines added to the job's active file since the last read.
+// A new file, or a file that has been truncated, is read from the start.
+func (t *tail) read(j *job) error {
+	files, err := getFileNames(j.logger(), j.dir)
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	if newest := files[len(files)-1]; newest != t.file {
+		*t = tail{file: newest}
+	}
+	f, err := os.Open(t.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < t.offset {
+		*t = tail{file: t.file}
+	}
+	if _, err := f.Seek(t.offset, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	// Only complete lines are used, as the last line may still be being written.
+	n := bytes.LastIndexByte(data, '\n') + 1
+	data = data[:n]
+	if t.start == 0 {
+		// The header may follow a preamble, and be followed by a line of units.
+		h, ok := headerEnd(data)
+		if !ok {
+			return nil
+		}
+		t.start = int64(h)
+		data = data[h:]
+	}
+	t.offset += int64(n)
+	if len(data) == 0 {
+		return nil
+	}
+	// The header block is read again, so that the data is parsed with its header.
+	header := io.NewSectionReader(f, 0, t.start)
+	_, err = parseCSV(j.logger(), t.file, io.MultiReader(header, bytes.NewReader(data)), j.stats, j.location(), time.Time{}, time.Time{})
+	return err
+}
+
+// push imports the records for the hours completed since the latest
+// record in Home Assistant, continuing its sum.
+func (st *imported) push(s *stat) error {
+	n := len(s.values)
+	if n == 0 {
+		return nil
+	}
+	last := s.values[n-1].t
+	var recs []map[string]interface{}
+	latest, ref := st.latest, st.ref
+	for _, r := range s.records(time.Hour, span{}) {
+		if !st.init && r.start.Equal(st.latest) {
+			st.ref = r.sum
+		}
+		// Only records after the latest, for hours that are complete.
+		if !r.start.After(st.latest) || r.start.Add(time.Hour).After(last) {
+			continue
+		}
+		start := r.start.In(time.UTC).Format(time.RFC3339)
+		if r.mean {
+			recs = append(recs, map[string]interface{}{"start": start, "mean": r.avg, "min": r.min, "max": r.max})
+		} else {
+			sum := st.sum + float64(r.sum-st.ref)
+			recs = append(recs, map[string]interface{}{"start": start, "state": r.state, "sum": sum})
+		}
+		latest, ref = r.start, r.sum
+	}
+	st.init = true
+	if len(recs) == 0 {
+		return nil
+	}
+	// If the import fails, the records are retried next time.
+	if err := api.importStatistics(s, recs); err != nil {
+		return err
+	}
+	log.Printf("%s: imported %d records up to %s", s.id, len(recs), latest.In(csvLoc).Format(tFmt))
+	if !s.mean {
+		st.sum += float64(ref - st.ref)
+	}
+	st.latest, st.ref = latest, ref
+	// Samples before the latest record are no longer needed, apart
+	// from the last one.
+	keep := st.latest.Add(-time.Hour)
+	i := 0
+	for i < n-1 && s.values[i].t.Before(keep) {
+		i++
+	}
+	s.values = s.values[i:]
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The active file is read as it is written, with a preamble and a line of
+// units before the data, and the last line still being written.
+func TestTailRead(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "2023-01-01.csv")
+	s := &stat{name: "import", column: h_import, unit: "kWh", scale: 1}
+	j := &job{name: "test", dir: dir, stats: []*stat{s}, loc: time.UTC}
+	tl := &tail{}
+	write := func(data string) {
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString(data); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	steps := []struct {
+		data   string
+		values int // Number of samples read so far
+		sum    float32
+	}{
+		{"; Exported by Logger\n# Serial: 1234\ndate,time,IMP\n", 0, 0},
+		{",,Wh\n2023-01-01,00:00,1000\n2023-01-01,00:05,15", 1, 0},
+		{"00\n2023-01-01,00:10,2000\n", 3, 1},
+		{"2023-01-01,00:15,2500\n", 4, 1.5},
+	}
+	for i, st := range steps {
+		write(st.data)
+		if err := tl.read(j); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if len(s.values) != st.values {
+			t.Fatalf("step %d: %d samples, expected %d", i, len(s.values), st.values)
+		}
+		if n := len(s.values); n != 0 && s.values[n-1].sum != st.sum {
+			t.Errorf("step %d: sum %f, expected %f (kWh)", i, s.values[n-1].sum, st.sum)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Built-in formats of the files produced by MeterMan, so that
+// the columns of its other output flavours don't need to be mapped by hand.
+// A format sets the defaults of other flags, which may still be overridden.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var csvFormat = flag.String("format", "meterman", "Format of the CSV files: meterman, meterman-daily (daily summary files) or meterman-power (with IN-P power)")
+
+// A built-in file format.
+type fileFormat struct {
+	flags  map[string]string // Defaults of other flags
+	dayEnd bool              // Rows without a time are readings at the end of the day
+}
+
+var formats = map[string]fileFormat{
+	"meterman":       {},
+	"meterman-daily": {dayEnd: true},
+	"meterman-power": {flags: map[string]string{"power-col": "IN-P", "power-unit": "kW", "power-id": "sensor.meterman_power"}},
+}
+
+// Rows without a time are readings at the end of the day, rather than the start.
+var dayEnd bool
+
+// applyFormat sets the defaults of the selected format, for the
+// flags that have not been explicitly set.
+func applyFormat() error {
+	f, ok := formats[*csvFormat]
+	if !ok {
+		return fmt.Errorf("%s: unknown format", *csvFormat)
+	}
+	for name, v := range f.flags {
+		if !flagSet(name) {
+			if err := flag.Set(name, v); err != nil {
+				return err
+			}
+		}
+	}
+	dayEnd = f.dayEnd
+	return nil
+}
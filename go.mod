@@ -1,3 +1,13 @@
 module github.com/aamcrae/ha-backfill
 
 go 1.18
+
+require (
+	github.com/go-sql-driver/mysql v1.7.1
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.17
+	golang.org/x/net v0.23.0
+	golang.org/x/term v0.18.0
+)
+
+require golang.org/x/sys v0.18.0 // indirect
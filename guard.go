@@ -0,0 +1,62 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Guard against applying the generated SQL to a database with a different
+// recorder schema version than the one it was generated for. The guard
+// inserts the result of checking schema_changes into a temporary table
+// with a CHECK constraint, which fails if the version does not match.
+
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+)
+
+var schemaVersion = flag.Int("schema-version", 0, "Recorder schema version the SQL is generated for, checked when the SQL is applied (by default, that of the database if there is one)")
+
+// Name of the temporary table used to check the schema version.
+const guardTable = "backfill_schema_guard"
+
+// setupSchemaGuard reads the schema version from the database, unless it is set.
+func setupSchemaGuard() error {
+	if *schemaVersion != 0 || db == nil {
+		return nil
+	}
+	var v sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(schema_version) FROM " + *tablePrefix + "schema_changes").Scan(&v); err != nil {
+		log.Printf("schema_changes: %v, the schema version is not checked", err)
+		return nil
+	}
+	if !v.Valid {
+		return fmt.Errorf("schema_changes: no schema version found")
+	}
+	*schemaVersion = int(v.Int64)
+	return nil
+}
+
+// schemaGuardSQL generates the statements that check the schema version.
+func schemaGuardSQL() {
+	if *schemaVersion == 0 {
+		return
+	}
+	table, col := quoteIdent(guardTable), quoteIdent("schema_version_ok")
+	fmt.Fprintf(sqlOut, "-- Schema version: %d\n", *schemaVersion)
+	fmt.Fprintf(sqlOut, "CREATE %s %s (%s INTEGER CHECK (%s = 1));\n", tempTable(), table, col, col)
+	fmt.Fprintf(sqlOut, "INSERT INTO %s SELECT CASE WHEN MAX(%s) = %d THEN 1 ELSE 0 END FROM %s;\n",
+		table, quoteIdent("schema_version"), *schemaVersion, quoteIdent(*tablePrefix+"schema_changes"))
+	fmt.Fprintf(sqlOut, "DROP %s %s;\n", dropTemp(), table)
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Integration of the preview server with Home Assistant. Backfills are
+// triggered from HA via a rest_command calling /api/run, and the state
+// of each task is published to HA as an entity (e.g sensor.ha_backfill),
+// so that automations and scripts can wait for, and react to, its completion.
+
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+	"sync"
+)
+
+var haEntity = flag.String("ha-entity", "", "Home Assistant entity the state of the preview server's tasks is published to e.g sensor.ha_backfill")
+
+// State of a task published to Home Assistant.
+type haState struct {
+	State      string                 `json:"state"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+var haPublish chan haState
+var haPublishOnce sync.Once
+
+// publishTask publishes the task's current state to Home Assistant.
+// The states are posted in order by a separate goroutine, so that
+// tasks are not held up by Home Assistant.
+func publishTask(t *rpcTask) {
+	if *haEntity == "" || *haURL == "" {
+		return
+	}
+	haPublishOnce.Do(func() {
+		haPublish = make(chan haState, 100)
+		go haPublisher()
+	})
+	t.mu.Lock()
+	s := haState{State: t.state, Attributes: map[string]interface{}{
+		"friendly_name": "Backfill",
+		"task":          t.number,
+		"job":           t.args.Job,
+		"dir":           t.args.Dir,
+		"apply":         t.args.Apply,
+	}}
+	if t.err != nil {
+		s.Attributes["error"] = t.err.Error()
+	}
+	if n := len(t.events); n != 0 {
+		s.Attributes["message"] = t.events[n-1]
+	}
+	t.mu.Unlock()
+	select {
+	case haPublish <- s:
+	default:
+		log.Printf("%s: too many states queued, state %s of task %d dropped", *haEntity, s.State, t.number)
+	}
+}
+
+// haPublisher posts the published states to Home Assistant.
+func haPublisher() {
+	url := strings.TrimSuffix(*haURL, "/") + "/api/states/" + *haEntity
+	for s := range haPublish {
+		if err := postHA(url, s); err != nil {
+			log.Printf("%s: %v", *haEntity, err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Location of the header line of a CSV file. Some loggers write a block
+// of comments or metadata (e.g "; Exported by ..." or "# Serial: 1234")
+// before the header, so the header is taken as the first line with a
+// date column. The header may also be followed by a line of the units
+// of the columns, which are added to the column names e.g "IMP (kWh)".
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Maximum number of lines before the header line.
+const maxPreamble = 50
+
+// csvReader returns a CSV reader of the input starting at the header line,
+// and the number of lines skipped before it. If no header line is found,
+// the input is read from the start.
+func csvReader(in io.Reader) (*csv.Reader, int, error) {
+	br := bufio.NewReader(in)
+	var preamble strings.Builder
+	start, skipped := "", 0
+	for i := 0; i < maxPreamble && start == ""; i++ {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		if isHeader(line) {
+			start, skipped = line, i
+		} else {
+			preamble.WriteString(line)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if start == "" {
+		start = preamble.String()
+	}
+	r := csv.NewReader(io.MultiReader(strings.NewReader(start), br))
+	// Rows with the wrong number of columns are skipped rather than failing the file.
+	r.FieldsPerRecord = -1
+	return r, skipped, nil
+}
+
+// headerEnd returns the offset of the data after the header line, and any
+// line of units, in the complete lines at the start of a file, located in
+// the same way as by csvReader. False is returned if more lines are needed.
+func headerEnd(data []byte) (int, bool) {
+	var ends []int // Offset of the end of each line
+	header := -1
+	for off := 0; len(ends) < maxPreamble+1; {
+		n := bytes.IndexByte(data[off:], '\n')
+		if n == -1 {
+			break
+		}
+		if header == -1 && len(ends) < maxPreamble && isHeader(string(data[off:off+n+1])) {
+			header = len(ends)
+		}
+		off += n + 1
+		ends = append(ends, off)
+	}
+	if header == -1 {
+		if len(ends) <= maxPreamble {
+			return 0, false
+		}
+		// As with csvReader, the first line is the header if no header is found.
+		header = 0
+	}
+	// The line after the header is needed to know whether it is a line of units.
+	if len(ends) <= header+1 {
+		return 0, false
+	}
+	start := 0
+	if header > 0 {
+		start = ends[header-1]
+	}
+	r := csv.NewReader(bytes.NewReader(data[start:ends[header+1]]))
+	r.FieldsPerRecord = -1
+	h, err1 := r.Read()
+	row, err2 := r.Read()
+	if err1 == nil && err2 == nil && addUnits(h, row) {
+		return ends[header+1], true
+	}
+	return ends[header], true
+}
+
+// isHeader returns true if the line is a header line with a date column.
+func isHeader(line string) bool {
+	fields, err := csv.NewReader(strings.NewReader(line)).Read()
+	if err != nil {
+		return false
+	}
+	for _, f := range fields {
+		if matchHeader(h_date, strings.TrimSpace(f)) {
+			return true
+		}
+	}
+	return false
+}
+
+// addUnits adds the units in the row to the names in the header,
+// returning false if the row is not a row of units. Rows of data
+// always have a date, so a row of units has no values starting with a digit.
+func addUnits(header, row []string) bool {
+	if len(row) != len(header) {
+		return false
+	}
+	found := false
+	for _, u := range row {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		if strings.IndexAny(u[:1], "0123456789+-.") == 0 {
+			return false
+		}
+		found = true
+	}
+	if !found {
+		return false
+	}
+	for i, u := range row {
+		u = strings.Trim(strings.TrimSpace(u), "()[]")
+		if u != "" && !matchHeader(h_date, header[i]) && !matchHeader(h_time, header[i]) {
+			header[i] = fmt.Sprintf("%s (%s)", header[i], u)
+		}
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHeaderEnd(t *testing.T) {
+	const header = "date,time,IMP\n"
+	const units = ",,kWh\n"
+	const row = "2023-01-01,00:00,1.5\n"
+	tests := []struct {
+		name string
+		data string
+		end  int // Offset of the data, or -1 if more lines are needed
+	}{
+		{"header", header + row, len(header)},
+		{"header only", header, -1},
+		{"partial", "; Exported by", -1},
+		{"preamble", "; Exported by Logger\n# Serial: 1234, site A\n" + header + row, len(header) + 44},
+		{"preamble only", "; Exported by Logger\n", -1},
+		{"units", header + units + row, len(header + units)},
+		{"preamble and units", "; Logger\n" + header + units, len("; Logger\n" + header + units)},
+		{"meterman", "#date,time,IMP,EXP\n" + row, len("#date,time,IMP,EXP\n")},
+		{"no header", strings.Repeat("1,2\n", maxPreamble+1), len("1,2\n")},
+	}
+	for _, tc := range tests {
+		end, ok := headerEnd([]byte(tc.data))
+		if !ok {
+			end = -1
+		}
+		if end != tc.end {
+			t.Errorf("%s: data at %d, expected %d", tc.name, end, tc.end)
+		}
+	}
+}
+
+func TestCSVReader(t *testing.T) {
+	in := "; Exported by Logger\n# Serial: 1234, site A\ndate,time,IMP\n,,kWh\n2023-01-01,00:00,1.5\n"
+	r, skipped, err := csvReader(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 2 {
+		t.Errorf("%d lines skipped, expected 2", skipped)
+	}
+	rows, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || !addUnits(rows[0], rows[1]) {
+		t.Fatalf("rows %q, expected a header, units and data", rows)
+	}
+	if got := strings.Join(rows[0], ","); got != "date,time,IMP (kWh)" {
+		t.Errorf("header %q, expected the units to be added", got)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Resampling of the readings to the hourly and 5 minute periods of the statistics.
+//
+// Utility interval data, where each row holds the energy used in a fixed
+// interval (e.g 15 or 30 minutes) ending at the row time rather than a meter reading,
+// is accumulated into a running sum, and by default is resampled by spreading
+// the energy of each interval evenly across it. Readings that are far apart,
+// such as daily readings, may be distributed using an hourly profile.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var interval = flag.Duration("interval", 0, "Length of the intervals of interval data e.g 30m (0 if the columns are meter readings)")
+var resampleGap = flag.Duration("resample-max-gap", time.Hour, "Maximum time between readings that is resampled")
+var resampling sensorList
+
+func init() {
+	flag.Var(&resampling, "resample", "Resampling of a statistic, as NAME=STRATEGY where STRATEGY is exact, last, linear or spread (may be repeated)")
+}
+
+// Resampling strategies.
+const (
+	resampleExact   = "exact"   // Only readings at the end of each period are used
+	resampleLast    = "last"    // The last reading before the end of each period
+	resampleLinear  = "linear"  // Readings are linearly interpolated
+	resampleSpread  = "spread"  // Energy between readings is spread evenly across the periods
+	resampleProfile = "profile" // Energy between readings is distributed using an hourly profile
+)
+
+// validResample returns true if the resampling strategy is known.
+func validResample(r string) bool {
+	switch r {
+	case resampleExact, resampleLast, resampleLinear, resampleSpread, resampleProfile:
+		return true
+	}
+	return false
+}
+
+// setInterval marks the accumulating statistics as holding interval data.
+func setInterval(stats []*stat, d time.Duration) error {
+	if d == 0 {
+		return nil
+	}
+	if d < time.Minute*5 || (time.Hour%d != 0 && d != time.Hour*24) {
+		return fmt.Errorf("%s: interval must divide an hour or be 24h, and be at least 5 minutes", d)
+	}
+	for _, s := range stats {
+		if !s.mean {
+			s.interval = d
+		}
+	}
+	return nil
+}
+
+// setResample applies the -resample flags to the statistics.
+func setResample(stats []*stat) error {
+	for _, r := range resampling {
+		name, strategy, _ := strings.Cut(r, "=")
+		if !validResample(strategy) {
+			return fmt.Errorf("%s: unknown resampling strategy", r)
+		}
+		found := false
+		for _, s := range stats {
+			if s.name == name && !s.mean {
+				s.resample = strategy
+				found = true
+			}
+			if s.resample == resampleProfile && s.profile == nil {
+				p, err := readProfile(*profileName)
+				if err != nil {
+					return err
+				}
+				s.profile = p
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: unknown statistic", r)
+		}
+	}
+	return nil
+}
+
+// resampled returns the samples at the end of each period. Readings that are
+// further apart than the period are resampled according to the strategy
+// of the statistic, which for interval data defaults to spreading the
+// energy of each interval, and otherwise to using only the exact readings.
+func (s *stat) resampled(period time.Duration) []sample {
+	strategy := s.resample
+	if strategy == "" {
+		strategy = resampleExact
+		if s.interval != 0 {
+			strategy = resampleSpread
+		}
+	}
+	if strategy == resampleExact && s.billed.IsZero() {
+		return s.values
+	}
+	var res []sample
+	for i, v := range s.values {
+		if i == 0 {
+			res = append(res, v)
+			continue
+		}
+		p := s.values[i-1]
+		gap := v.t.Sub(p.t)
+		limit := *resampleGap
+		if strategy == resampleProfile && limit < profileGap {
+			limit = profileGap
+		}
+		strategy := strategy
+		if !v.t.After(s.billed) {
+			// Billing periods are always resampled, and spread evenly by default.
+			limit = gap
+			if strategy != resampleProfile {
+				strategy = resampleSpread
+			}
+		} else if strategy == resampleExact || (s.interval != 0 && !s.complete(p.t, v.t)) {
+			// Interval data is only resampled within complete intervals,
+			// since the energy of a missing interval is unknown.
+			res = append(res, v)
+			continue
+		}
+		if gap <= period || gap > limit {
+			res = append(res, v)
+			continue
+		}
+		var total, w float64
+		if strategy == resampleProfile {
+			total = profileWeight(s.profile, p.t, v.t)
+		}
+		last := p.t
+		for t := p.t.Truncate(period).Add(period); t.Before(v.t); t = t.Add(period) {
+			f := float32(t.Sub(p.t)) / float32(gap)
+			if total > 0 {
+				w += profileWeight(s.profile, last, t)
+				last = t
+				f = float32(w / total)
+			}
+			n := p
+			n.t = t
+			switch strategy {
+			case resampleLinear:
+				// Both the reading and the sum are interpolated.
+				n.sum = p.sum + (v.sum-p.sum)*f
+				n.value = p.value + (v.value-p.value)*f
+				n.reset = v.reset
+			case resampleSpread, resampleProfile:
+				// The reading is derived from the energy, so that the
+				// energy is conserved even if the meter is reset.
+				n.sum = p.sum + (v.sum-p.sum)*f
+				n.value = p.value + (v.sum-p.sum)*f
+			}
+			res = append(res, n)
+		}
+		res = append(res, v)
+	}
+	return res
+}
+
+// complete returns true if the readings are a complete interval apart.
+// Daily intervals are a calendar day, which may not be 24 hours.
+func (s *stat) complete(a, b time.Time) bool {
+	if s.interval == time.Hour*24 {
+		return b.Equal(a.AddDate(0, 0, 1))
+	}
+	return b.Sub(a) == s.interval
+}
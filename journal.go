@@ -0,0 +1,263 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Journal of the SQL applied directly to the database, so that an apply
+// that is interrupted (e.g by a crash or a lost connection) can be
+// recovered deterministically by the next run. Before the SQL is applied,
+// it is written to the journal file along with its rollback, and the SQL
+// adds a row with the journal's id to a journal table in the same
+// transaction as the records. The row therefore exists only if the import
+// was committed, so the next run can tell whether to apply the SQL again
+// (or just the statements after the transaction) to finish the import, or
+// to apply the rollback to undo it. The journal file is removed once the
+// SQL is applied, or the interrupted apply is recovered.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var journalFile = flag.String("journal", "", "Journal file of the SQL applied directly via -apply or -serve, so that an interrupted apply can be recovered via -recover")
+var recoverMode = flag.String("recover", "", "Recover the interrupted apply in the -journal, then exit: finish (complete the import) or rollback (undo it)")
+
+// Recovery modes
+const (
+	recoverFinish   = "finish"
+	recoverRollback = "rollback"
+)
+
+// Table of the imports that have been committed, by journal id.
+const journalTable = "ha_backfill_journal"
+
+// First line of the journal file, followed by the id, and the line
+// separating the SQL from its rollback.
+const journalHeader = "-- ha-backfill journal "
+const journalSeparator = "-- ha-backfill journal rollback\n"
+
+// Id of the journal of the SQL generated, if journalling.
+var journalId string
+
+// Rollback of the SQL generated, if journalling.
+var journalRollback bytes.Buffer
+
+// journalName returns the name of the journal table.
+func journalName() string {
+	return *tablePrefix + journalTable
+}
+
+// checkJournal verifies that the journal can be used, and that there
+// is no interrupted apply to be recovered first.
+func checkJournal() error {
+	if *recoverMode != "" && *recoverMode != recoverFinish && *recoverMode != recoverRollback {
+		return fmt.Errorf("%s: unknown -recover mode", *recoverMode)
+	}
+	if *journalFile == "" {
+		if *recoverMode != "" {
+			return errors.New("-recover requires -journal")
+		}
+		return nil
+	}
+	if db == nil {
+		return errors.New("-journal requires -db or -database")
+	}
+	if *recoverMode != "" {
+		return nil
+	}
+	if !*applyDirect && *serve == "" {
+		return errors.New("-journal requires -apply or -serve")
+	}
+	if _, err := os.Stat(*journalFile); err == nil {
+		return fmt.Errorf("%s: an interrupted apply must be recovered first, via -recover finish or -recover rollback", *journalFile)
+	}
+	return nil
+}
+
+// newJournal sets a new id for the journal of the SQL to be generated.
+func newJournal() {
+	if *journalFile == "" {
+		return
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	journalId = hex.EncodeToString(id)
+}
+
+// journalTableSQL generates the SQL to create the journal table if it does
+// not already exist. As with the audit table, this is outside the transaction.
+func journalTableSQL() {
+	if *journalFile == "" {
+		return
+	}
+	fmt.Fprintf(sqlOut, "CREATE TABLE IF NOT EXISTS %s (%s VARCHAR(32), %s TIMESTAMP);\n",
+		quoteIdent(journalName()), quoteIdent("id"), quoteIdent("applied"))
+}
+
+// journalSQL generates the SQL to add the journal's row, within the transaction.
+func journalSQL() {
+	if *journalFile == "" {
+		return
+	}
+	fmt.Fprintf(sqlOut, "INSERT INTO %s (%s) VALUES (%s, CURRENT_TIMESTAMP);\n",
+		quoteIdent(journalName()), quoteIdents("id", "applied"), sqlQuote(journalId))
+}
+
+// journalRollbackSQL generates the SQL to remove the journal's row as
+// part of the rollback, since the import is then no longer applied.
+func journalRollbackSQL() {
+	if *journalFile == "" {
+		return
+	}
+	fmt.Fprintf(rollbackOut, "DELETE FROM %s WHERE %s = %s;\n", quoteIdent(journalName()), quoteIdent("id"), sqlQuote(journalId))
+}
+
+// applyJournaled applies the generated SQL as applySQL does, keeping the
+// journal of it while it is applied, and returning true if the import was
+// committed even though a later statement failed. If applying it fails,
+// the journal is kept unless the import is known not to have been committed.
+func applyJournaled(ctx context.Context, d *sql.DB, script []byte) (int, bool, error) {
+	if *journalFile == "" {
+		return applySQL(ctx, d, script)
+	}
+	if _, err := os.Stat(*journalFile); err == nil {
+		return 0, false, fmt.Errorf("%s: an interrupted apply must be recovered first, via -recover finish or -recover rollback", *journalFile)
+	}
+	if err := writeJournal(*journalFile, journalId, script, journalRollback.Bytes()); err != nil {
+		return 0, false, err
+	}
+	n, committed, err := applySQL(ctx, d, script)
+	if err != nil {
+		// The COMMIT itself may have failed after the import was committed.
+		if !committed {
+			var cerr error
+			if committed, cerr = journalCommitted(d, journalId); cerr != nil {
+				return n, false, fmt.Errorf("%v (the journal %s is kept for -recover)", err, *journalFile)
+			}
+		}
+		if committed {
+			return n, true, fmt.Errorf("%v (the journal %s is kept for -recover)", err, *journalFile)
+		}
+	}
+	if rerr := os.Remove(*journalFile); err == nil {
+		err = rerr
+	}
+	return n, committed, err
+}
+
+// writeJournal writes the journal file, which is synced before it
+// replaces any previous file, so that it is complete if it exists.
+func writeJournal(file, id string, script, rollback []byte) error {
+	tmp := filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	b.WriteString(journalHeader + id + "\n")
+	b.Write(script)
+	b.WriteString(journalSeparator)
+	b.Write(rollback)
+	_, err = f.Write(b.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// readJournal reads the journal file, returning its id, SQL and rollback.
+func readJournal(file string) (string, []byte, []byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	first, rest, _ := bytes.Cut(data, []byte("\n"))
+	script, rollback, ok := bytes.Cut(rest, []byte(journalSeparator))
+	if !bytes.HasPrefix(first, []byte(journalHeader)) || !ok {
+		return "", nil, nil, fmt.Errorf("%s: not a journal", file)
+	}
+	return string(bytes.TrimPrefix(first, []byte(journalHeader))), script, rollback, nil
+}
+
+// journalCommitted returns true if the import of the journal was committed.
+func journalCommitted(d *sql.DB, id string) (bool, error) {
+	// Without the table, no journaled import has been committed, but any
+	// other error (e.g a dropped connection) leaves it unknown.
+	if err := checkColumns(d, journalName(), []string{"id"}); errors.Is(err, errNoTable) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	var n int
+	q := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s = %s", quoteIdent(journalName()), quoteIdent("id"), sqlQuote(id))
+	if err := d.QueryRow(q).Scan(&n); err != nil {
+		return false, err
+	}
+	return n != 0, nil
+}
+
+// recoverJournal finishes or rolls back the interrupted apply of the
+// journal, and removes the journal.
+func recoverJournal() error {
+	id, script, rollback, err := readJournal(*journalFile)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s: no interrupted apply to recover", *journalFile)
+	} else if err != nil {
+		return err
+	}
+	committed, err := journalCommitted(db, id)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	switch {
+	case *recoverMode == recoverFinish && committed:
+		// Only the statements after the transaction (e.g ANALYZE) may not have been applied.
+		log.Printf("%s: the import was committed, applying the statements after it", *journalFile)
+		_, after, _ := bytes.Cut(script, []byte("\nCOMMIT;\n"))
+		_, _, err = applySQL(ctx, db, after)
+	case *recoverMode == recoverFinish:
+		log.Printf("%s: the import was not committed, applying it again", *journalFile)
+		_, _, err = applySQL(ctx, db, script)
+	case committed:
+		log.Printf("%s: the import was committed, applying its rollback", *journalFile)
+		_, _, err = applySQL(ctx, db, rollback)
+	default:
+		log.Printf("%s: the import was not committed, so there is nothing to roll back", *journalFile)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(*journalFile)
+}
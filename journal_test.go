@@ -0,0 +1,176 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An interrupted apply is finished or rolled back according to whether
+// its import was committed.
+func TestJournalRecover(t *testing.T) {
+	dir := t.TempDir()
+	csvDir := filepath.Join(dir, "csv")
+	if err := os.Mkdir(csvDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	b.WriteString("Date,Time,IMP\n")
+	base := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= 24; i++ {
+		tm := base.Add(time.Minute * 5 * time.Duration(i))
+		fmt.Fprintf(&b, "%s,%s,%.1f\n", tm.Format("2006-01-02"), tm.Format("15:04"), 100+float64(i)/10)
+	}
+	if err := os.WriteFile(filepath.Join(csvDir, "2022-04-01.csv"), []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	savedDB, savedLoc, savedJournal, savedRecover, savedApply := db, csvLoc, *journalFile, *recoverMode, *applyDirect
+	defer func() {
+		db, csvLoc, *journalFile, *recoverMode, *applyDirect = savedDB, savedLoc, savedJournal, savedRecover, savedApply
+	}()
+	csvLoc, *journalFile, *applyDirect = time.UTC, filepath.Join(dir, "journal.sql"), true
+	tests := []struct {
+		mode      string
+		committed bool // Whether the import was committed before the apply was interrupted
+		records   int  // Long term records once recovered
+	}{
+		{recoverFinish, false, 3},
+		{recoverFinish, true, 3},
+		{recoverRollback, true, 0},
+		{recoverRollback, false, 0},
+	}
+	for i, tc := range tests {
+		name := fmt.Sprintf("%s (committed %v)", tc.mode, tc.committed)
+		d, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, fmt.Sprintf("test%d.db", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		if err := createSchema(d); err != nil {
+			t.Fatal(err)
+		}
+		db = d
+		j := &job{name: "test", dir: csvDir, stats: []*stat{{name: "import", column: "IMP", id: selftestId, unit: "kWh", scale: 1}}}
+		closeRollback, err := openRollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+		script, err := captureSQL(func() error { return generate(context.Background(), []*job{j}, span{}, span{}) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := closeRollback(); err != nil {
+			t.Fatal(err)
+		}
+		rollback := append([]byte(nil), journalRollback.Bytes()...)
+		if tc.committed {
+			if _, _, err := applySQL(context.Background(), d, script); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		if err := writeJournal(*journalFile, journalId, script, rollback); err != nil {
+			t.Fatal(err)
+		}
+		*recoverMode = ""
+		if err := checkJournal(); err == nil {
+			t.Errorf("%s: the interrupted apply was not found", name)
+		}
+		*recoverMode = tc.mode
+		if err := recoverJournal(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := os.Stat(*journalFile); !os.IsNotExist(err) {
+			t.Errorf("%s: journal not removed", name)
+		}
+		var n int
+		if err := d.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", quoteIdent(longName()))).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != tc.records {
+			t.Errorf("%s: %d records, expected %d", name, n, tc.records)
+		}
+		committed, err := journalCommitted(d, journalId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if committed != (tc.records != 0) {
+			t.Errorf("%s: committed %v once recovered", name, committed)
+		}
+	}
+}
+
+// Only a missing journal table shows the import was not committed; any
+// other error leaves it unknown.
+func TestJournalCommitted(t *testing.T) {
+	d, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if committed, err := journalCommitted(d, "id"); committed || err != nil {
+		t.Errorf("no journal table: committed %v, error %v, expected not committed", committed, err)
+	}
+	d.Close()
+	if _, err := journalCommitted(d, "id"); err == nil {
+		t.Errorf("closed database: no error, expected an error")
+	}
+}
+
+// A failure after the COMMIT is reported as committed, and the journal is
+// kept, while one before it is rolled back and the journal removed.
+func TestApplyCommitted(t *testing.T) {
+	dir := t.TempDir()
+	saved := *journalFile
+	defer func() { *journalFile = saved }()
+	tests := []struct {
+		name      string
+		journal   bool
+		script    string
+		committed bool
+		n         int
+	}{
+		{"after commit", false, "BEGIN;\nCREATE TABLE t (x INTEGER);\nCOMMIT;\nNOT SQL;\n", true, 3},
+		{"before commit", false, "BEGIN;\nCREATE TABLE t (x INTEGER);\nNOT SQL;\nCOMMIT;\n", false, 2},
+		{"journaled after commit", true, "BEGIN;\nCREATE TABLE t (x INTEGER);\nCOMMIT;\nNOT SQL;\n", true, 3},
+		{"journaled before commit", true, "BEGIN;\nCREATE TABLE t (x INTEGER);\nNOT SQL;\nCOMMIT;\n", false, 2},
+	}
+	for i, tc := range tests {
+		d, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, fmt.Sprintf("test%d.db", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		*journalFile = ""
+		if tc.journal {
+			*journalFile = filepath.Join(dir, fmt.Sprintf("journal%d.sql", i))
+		}
+		n, committed, err := applyJournaled(context.Background(), d, []byte(tc.script))
+		if err == nil || committed != tc.committed || n != tc.n {
+			t.Errorf("%s: %d statements, committed %v, error %v, expected %d statements, committed %v and an error",
+				tc.name, n, committed, err, tc.n, tc.committed)
+		}
+		if tc.journal {
+			if _, err := os.Stat(*journalFile); (err == nil) != tc.committed {
+				t.Errorf("%s: journal kept %v, expected %v", tc.name, err == nil, tc.committed)
+			}
+		}
+	}
+}
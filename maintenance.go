@@ -0,0 +1,105 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Database maintenance statements appended to the generated SQL, so that
+// the query planner statistics are refreshed after inserting a large
+// number of records, and the space freed by deleting records is reclaimed.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+)
+
+var analyze = flag.String("analyze", "", "Append statements to refresh the query planner statistics after the import, for the database type: sqlite, mysql or postgresql")
+
+var vacuum = flag.String("vacuum", "", "Append a statement to reclaim the space freed in a SQLite database after the import: full or incremental")
+
+// Vacuum modes
+const vacuumFull = "full"               // The whole database is rebuilt
+const vacuumIncremental = "incremental" // The free pages are released (requires auto_vacuum=INCREMENTAL)
+
+// checkAnalyze validates the -analyze database type against the SQL dialect.
+func checkAnalyze() error {
+	if *analyze == "" {
+		return nil
+	}
+	if *analyze != dialectSQLite && *analyze != dialectMySQL && *analyze != dialectPostgres {
+		return fmt.Errorf("%s: unknown -analyze database type", *analyze)
+	}
+	if *analyze != dialect {
+		return fmt.Errorf("-analyze %s does not match the %s SQL dialect (see -dialect)", *analyze, dialect)
+	}
+	return nil
+}
+
+// checkVacuum validates the -vacuum mode against the database, if there is
+// one, and warns of the downtime and disk space needed.
+func checkVacuum() error {
+	if *vacuum == "" {
+		return nil
+	}
+	if *vacuum != vacuumFull && *vacuum != vacuumIncremental {
+		return fmt.Errorf("%s: unknown -vacuum mode", *vacuum)
+	}
+	if dialect != dialectSQLite {
+		return fmt.Errorf("-vacuum is only supported for SQLite databases")
+	}
+	if db != nil {
+		var pages, size, free, auto int64
+		for _, p := range []struct {
+			name string
+			v    *int64
+		}{{"page_count", &pages}, {"page_size", &size}, {"freelist_count", &free}, {"auto_vacuum", &auto}} {
+			if err := db.QueryRow("PRAGMA " + p.name).Scan(p.v); err != nil {
+				return fmt.Errorf("PRAGMA %s: %v", p.name, err)
+			}
+		}
+		// auto_vacuum is 2 for INCREMENTAL.
+		if *vacuum == vacuumIncremental && auto != 2 {
+			return fmt.Errorf("-vacuum incremental requires auto_vacuum=INCREMENTAL, use -vacuum full")
+		}
+		log.Printf("vacuum: database is %d MB, with %d MB currently free", pages*size>>20, free*size>>20)
+	}
+	if *vacuum == vacuumFull {
+		log.Printf("vacuum: warning: the database is locked while it is rebuilt, which may take many minutes, " +
+			"so Home Assistant should be stopped. Free disk space of up to twice the database size is needed")
+	}
+	return nil
+}
+
+// maintenanceSQL generates the maintenance statements, which are
+// run after the import's transaction is committed. The database is
+// vacuumed last, after the query planner statistics are refreshed.
+func maintenanceSQL() {
+	switch *analyze {
+	case dialectSQLite:
+		fmt.Fprintf(sqlOut, "ANALYZE %s;\n", quoteIdent(longName()))
+		fmt.Fprintf(sqlOut, "ANALYZE %s;\n", quoteIdent(shortName()))
+		fmt.Fprintln(sqlOut, "PRAGMA optimize;")
+	case dialectMySQL:
+		fmt.Fprintf(sqlOut, "ANALYZE TABLE %s;\n", quoteIdents(longName(), shortName()))
+	case dialectPostgres:
+		fmt.Fprintf(sqlOut, "ANALYZE %s;\n", quoteIdents(longName(), shortName()))
+	}
+	// Vacuuming cannot be done within a transaction.
+	switch *vacuum {
+	case vacuumFull:
+		fmt.Fprintln(sqlOut, "VACUUM;")
+	case vacuumIncremental:
+		fmt.Fprintln(sqlOut, "PRAGMA incremental_vacuum;")
+	}
+}
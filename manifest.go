@@ -0,0 +1,54 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Manifest of the input files that contributed to the generated SQL,
+// so that an import can later be audited, and modified files detected.
+
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+var manifestFile = flag.String("manifest", "", "File to write a manifest (path, SHA-256, rows, time range) of the CSV files read")
+
+// writeManifest writes the manifest as a CSV file.
+func writeManifest(file string, jobs []*job) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"#job", "file", "sha256", "rows", "first", "last"})
+	for _, j := range jobs {
+		for _, m := range j.manifest {
+			var first, last string
+			if m.rows != 0 {
+				first = m.first.Format(time.RFC3339)
+				last = m.last.Format(time.RFC3339)
+			}
+			w.Write([]string{j.name, m.file, fmt.Sprintf("%x", m.hash), fmt.Sprint(m.rows), first, last})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,403 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Reading of the CSV files as streams of rows, which are merged by time.
+// The rows of all the files are added to the statistics in time order,
+// regardless of the order of the file names, and files with overlapping
+// times (e.g a file rotated part way through a day) are interleaved.
+// Each file is opened when its first row is the next to be merged, and
+// read a row at a time, so only the files being merged are open, and the
+// files are not held in memory.
+
+package main
+
+import (
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// A stream of the rows of one CSV file, in the order they appear in the file.
+type csvStream struct {
+	file    string
+	stats   []*stat
+	loc     *time.Location
+	after   time.Time // Only rows after this time are used
+	until   time.Time // If set, only rows up to this time are used
+	in      io.Reader // Input, which is added to the hash as it is read
+	hash    hash.Hash
+	r       *csv.Reader // nil once the stream is finished
+	err     error
+	columns int // Number of columns in the header
+	dateCol int
+	timeCol int
+	cols    []int     // Columns of the statistics, or -1
+	scale   []float64 // Scale of the values of the statistics
+	pending []string  // Row already read after the header
+	row     int       // Row number from the start of the file, counting the header as row 0
+	data    int       // Number of rows of data read
+	prev    time.Time // Time of the previous row
+	tm      time.Time // Time of the current row
+	timed   bool      // Whether the current row has a time of day
+	values  []string  // Values of the current row
+	summary *fileSummary
+	warn    *rowWarnings
+	log     *log.Logger
+}
+
+// newStream starts a stream of the rows of CSV data read from the named
+// source, with local times in the location, and messages about it logged
+// to the logger. next must be called to read the first row.
+func newStream(logger *log.Logger, file string, in io.Reader, stats []*stat, loc *time.Location, after, until time.Time) (*csvStream, error) {
+	cs := &csvStream{
+		file:    file,
+		stats:   stats,
+		loc:     loc,
+		after:   after,
+		until:   until,
+		hash:    sha256.New(),
+		dateCol: -1,
+		timeCol: -1,
+		cols:    make([]int, len(stats)),
+		scale:   make([]float64, len(stats)),
+		summary: &fileSummary{file: file},
+		warn:    &rowWarnings{file: file, log: logger},
+		log:     logger,
+	}
+	cs.in = io.TeeReader(in, cs.hash)
+	r, skipped, err := csvReader(cs.in)
+	if err != nil {
+		return nil, err
+	}
+	cs.r = r
+	cs.row = skipped
+	header, err := r.Read()
+	if err == io.EOF {
+		// File must contain at least a header line and one line of data
+		cs.log.Printf("%s: empty file", file)
+		cs.finish()
+		return cs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The data starts after the header line, and any line of units.
+	if row, err := r.Read(); err == nil {
+		if addUnits(header, row) {
+			cs.row++
+		} else {
+			cs.pending = row
+		}
+	} else if err != io.EOF {
+		return nil, err
+	}
+	cs.columns = len(header)
+	// Find columns in header line
+	for i := range cs.cols {
+		cs.cols[i] = -1
+	}
+	for i, s := range header {
+		switch {
+		case matchHeader(h_date, s):
+			cs.dateCol = i
+
+		case matchHeader(h_time, s):
+			cs.timeCol = i
+
+		default:
+			// The header may include the units, in which case the
+			// values are converted to the units of the statistic.
+			base, unit := splitUnit(s)
+			for j, st := range stats {
+				if matchHeader(st.column, s) {
+					cs.cols[j] = i
+					cs.scale[j] = 1
+				} else if unit != "" && matchHeader(st.column, base) {
+					cs.cols[j] = i
+					cs.scale[j] = st.headerScale(unit)
+				}
+			}
+		}
+	}
+	if cs.dateCol == -1 {
+		cs.log.Printf("%s: cannot find date", file)
+		cs.finish()
+	}
+	return cs, nil
+}
+
+// next reads the next row to be used, returning false once the
+// stream is finished.
+func (cs *csvStream) next() bool {
+	for cs.r != nil {
+		data := cs.pending
+		cs.pending = nil
+		if data == nil {
+			var err error
+			data, err = cs.r.Read()
+			if err != nil {
+				if err != io.EOF {
+					cs.err = err
+				}
+				break
+			}
+		}
+		cs.row++
+		cs.data++
+		if len(data) != cs.columns {
+			cs.warn.add(cs.row, "mismatch in column count", "%d columns", len(data))
+			cs.summary.skipped++
+			continue
+		}
+		// Daily readings without a time are taken at the start of the day.
+		clock := "00:00"
+		if cs.timeCol != -1 {
+			clock = data[cs.timeCol]
+		}
+		timed := cs.timeCol != -1 || timestampDate(data[cs.dateCol])
+		// Times with an offset from UTC are used as is, otherwise they are local times.
+		tm, offset, err := parseOffset(data[cs.dateCol], clock, cs.loc)
+		if !offset {
+			tm, err = parseLocal(data[cs.dateCol], clock, cs.loc, cs.prev)
+		}
+		if err != nil {
+			cs.warn.add(cs.row, "cannot parse date", "%s %s: %v", data[cs.dateCol], clock, err)
+			cs.summary.skipped++
+			continue
+		}
+		if tm.Equal(cs.prev) {
+			cs.warn.add(cs.row, "duplicate time", "%s %s", data[cs.dateCol], clock)
+			cs.summary.skipped++
+			continue
+		}
+		cs.prev = tm
+		if !tm.After(cs.after) || (!cs.until.IsZero() && tm.After(cs.until)) {
+			continue
+		}
+		cs.tm, cs.timed, cs.values = tm, timed, data
+		return true
+	}
+	if cs.r != nil && cs.err == nil && cs.data == 0 {
+		cs.log.Printf("%s: empty file", cs.file)
+	}
+	cs.finish()
+	return false
+}
+
+// finish reads the rest of the input so that the hash is of the whole
+// file, and logs the rows skipped.
+func (cs *csvStream) finish() {
+	if cs.r == nil {
+		return
+	}
+	cs.r = nil
+	if _, err := io.Copy(io.Discard, cs.in); err != nil && cs.err == nil {
+		cs.err = err
+	}
+	cs.summary.hash = cs.hash.Sum(nil)
+	cs.warn.flush()
+}
+
+// add adds the values of the current row to the statistics.
+func (cs *csvStream) add() {
+	// Times that have already been read (e.g from a backup copy of
+	// a file) are only used once.
+	used, covered := false, false
+	for j, st := range cs.stats {
+		if cs.cols[j] == -1 {
+			continue
+		}
+		// Daily interval data covers the whole day, and daily summary
+		// readings are taken at the end of the day, so both are at the next day.
+		t := cs.tm
+		if !cs.timed && (st.interval == time.Hour*24 || dayEnd) {
+			t = cs.tm.AddDate(0, 0, 1)
+		}
+		if st.covers(t) {
+			covered = true
+			continue
+		}
+		st.addValue(cs.values[cs.cols[j]], cs.scale[j], t, source{cs.file, cs.row + 1})
+		used = true
+	}
+	if covered && !used {
+		cs.summary.overlap++
+		return
+	}
+	if cs.summary.rows == 0 {
+		cs.summary.first = cs.tm
+	}
+	cs.summary.last = cs.tm
+	cs.summary.rows++
+}
+
+// A CSV file being merged, ordered by the time of its next row.
+type mergeFile struct {
+	name   string
+	index  int       // Position in the list of files, which orders rows with the same time
+	until  time.Time // If set, only rows up to this time are read
+	t      time.Time // Time of the next row
+	f      *os.File
+	stream *csvStream // Set once the file is opened for merging
+}
+
+// Files being merged, as a heap with the file with the earliest next row first.
+type mergeHeap []*mergeFile
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].t.Equal(h[j].t) {
+		return h[i].index < h[j].index
+	}
+	return h[i].t.Before(h[j].t)
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeFile)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	m := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return m
+}
+
+// readFiles reads the CSV files, merging their rows by time, and returns
+// the summaries of the files in the order of the files. The summary of a
+// file that is skipped, or cannot be read, is nil. If the context is
+// cancelled, reading stops at the next file.
+func (j *job) readFiles(ctx context.Context, files []string) ([]*fileSummary, error) {
+	summaries := make([]*fileSummary, len(files))
+	// Find the time of the first row of each file.
+	var merging mergeHeap
+	defer func() {
+		for _, m := range merging {
+			if m.f != nil {
+				m.f.Close()
+			}
+		}
+	}()
+	for i, file := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		m, summary, err := probeCSV(j.logger(), file, j.stats, j.location())
+		if err != nil {
+			j.logger().Printf("%s: %v\n", file, err)
+			j.errors++
+			continue
+		}
+		if m != nil {
+			m.index = i
+			merging = append(merging, m)
+		}
+		summaries[i] = summary
+	}
+	heap.Init(&merging)
+	for len(merging) != 0 {
+		m := merging[0]
+		if m.stream == nil {
+			// The file is opened again when its first row is the next to be merged.
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if err := m.open(j.logger(), j.stats, j.location()); err != nil {
+				j.logger().Printf("%s: %v\n", m.name, err)
+				j.errors++
+				heap.Pop(&merging)
+				continue
+			}
+		} else {
+			m.stream.add()
+		}
+		if m.stream.next() {
+			m.t = m.stream.tm
+			heap.Fix(&merging, 0)
+			continue
+		}
+		heap.Pop(&merging)
+		m.f.Close()
+		if m.stream.err != nil {
+			j.logger().Printf("%s: %v\n", m.name, m.stream.err)
+			j.errors++
+			continue
+		}
+		summaries[m.index] = m.stream.summary
+	}
+	return summaries, nil
+}
+
+// probeCSV opens one CSV file and finds the time of its first row.
+// If the file has rows to be merged, it is closed until they are merged,
+// otherwise its summary is returned. Nothing is returned if the file
+// is current and is skipped.
+func probeCSV(logger *log.Logger, file string, stats []*stat, loc *time.Location) (*mergeFile, *fileSummary, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Guard against rogue large files (e.g a log written to the directory).
+	if *maxSize > 0 && info.Size() > *maxSize*1024*1024 {
+		return nil, nil, fmt.Errorf("file too large (%d bytes, limit is %d MB), skipped", info.Size(), *maxSize)
+	}
+	skip, until := currentLimit(info)
+	if skip {
+		logger.Printf("%s: current file, skipped", file)
+		return nil, nil, nil
+	}
+	if !until.IsZero() {
+		logger.Printf("%s: current file, read up to %s", file, until.Format(tFmt))
+	}
+	cs, err := newStream(logger, file, f, stats, loc, time.Time{}, until)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cs.next() {
+		// The rows skipped are counted again when the file is merged.
+		return &mergeFile{name: file, until: until, t: cs.tm}, nil, nil
+	}
+	if cs.err != nil {
+		return nil, nil, cs.err
+	}
+	return nil, cs.summary, nil
+}
+
+// open opens the file again to merge its rows.
+func (m *mergeFile) open(logger *log.Logger, stats []*stat, loc *time.Location) error {
+	f, err := os.Open(m.name)
+	if err != nil {
+		return err
+	}
+	cs, err := newStream(logger, m.name, f, stats, loc, time.Time{}, m.until)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	m.f, m.stream = f, cs
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The rows of the files are merged by time, whatever the order of the
+// files, and times already read from another file, or earlier in the
+// same file, are only used once.
+func TestReadFiles(t *testing.T) {
+	saved := *current
+	defer func() { *current = saved }()
+	*current = currentRead
+	type file struct {
+		name string
+		rows []string // date,time,IMP rows
+	}
+	type summary struct {
+		rows, skipped, overlap int
+	}
+	tests := []struct {
+		name      string
+		files     []file
+		times     []string // Times of the samples read
+		values    []float32
+		summaries []summary // In the order of the files
+	}{
+		{"in order",
+			[]file{{"a.csv", []string{"00:00,1", "00:05,2"}}, {"b.csv", []string{"00:10,3", "00:15,4"}}},
+			[]string{"00:00", "00:05", "00:10", "00:15"}, []float32{1, 2, 3, 4},
+			[]summary{{2, 0, 0}, {2, 0, 0}}},
+		{"names out of order",
+			[]file{{"a.csv", []string{"00:10,3", "00:15,4"}}, {"b.csv", []string{"00:00,1", "00:05,2"}}},
+			[]string{"00:00", "00:05", "00:10", "00:15"}, []float32{1, 2, 3, 4},
+			[]summary{{2, 0, 0}, {2, 0, 0}}},
+		{"overlapping",
+			[]file{{"a.csv", []string{"00:00,1", "00:10,3", "00:20,5"}}, {"b.csv", []string{"00:05,2", "00:15,4"}}},
+			[]string{"00:00", "00:05", "00:10", "00:15", "00:20"}, []float32{1, 2, 3, 4, 5},
+			[]summary{{3, 0, 0}, {2, 0, 0}}},
+		{"duplicate file",
+			[]file{{"a.csv", []string{"00:00,1", "00:05,2"}}, {"a-copy.csv", []string{"00:00,1", "00:05,2"}}},
+			[]string{"00:00", "00:05"}, []float32{1, 2},
+			[]summary{{2, 0, 0}, {0, 0, 2}}},
+		{"duplicate times across files",
+			[]file{{"a.csv", []string{"00:00,1", "00:05,2", "00:10,3"}}, {"b.csv", []string{"00:10,3", "00:15,4"}}},
+			[]string{"00:00", "00:05", "00:10", "00:15"}, []float32{1, 2, 3, 4},
+			[]summary{{3, 0, 0}, {1, 0, 1}}},
+		{"duplicate time in a file",
+			[]file{{"a.csv", []string{"00:00,1", "00:05,2", "00:05,2", "00:10,3"}}},
+			[]string{"00:00", "00:05", "00:10"}, []float32{1, 2, 3},
+			[]summary{{3, 1, 0}}},
+	}
+	for _, tc := range tests {
+		dir := t.TempDir()
+		var files []string
+		for _, f := range tc.files {
+			var b strings.Builder
+			b.WriteString("date,time,IMP\n")
+			for _, r := range f.rows {
+				b.WriteString("2023-01-01," + r + "\n")
+			}
+			path := filepath.Join(dir, f.name)
+			if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+				t.Fatal(err)
+			}
+			files = append(files, path)
+		}
+		s := &stat{name: "import", column: "IMP", unit: "kWh", scale: 1}
+		j := &job{name: "test", dir: dir, stats: []*stat{s}, loc: time.UTC}
+		summaries, err := j.readFiles(context.Background(), files)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		var times []string
+		var values []float32
+		for _, v := range s.values {
+			times = append(times, v.t.Format("15:04"))
+			values = append(values, v.value)
+		}
+		if strings.Join(times, " ") != strings.Join(tc.times, " ") {
+			t.Errorf("%s: samples at %v, expected %v", tc.name, times, tc.times)
+		}
+		for i := range values {
+			if i < len(tc.values) && values[i] != tc.values[i] {
+				t.Errorf("%s: values %v, expected %v", tc.name, values, tc.values)
+				break
+			}
+		}
+		for i, want := range tc.summaries {
+			got := summaries[i]
+			if got == nil {
+				t.Errorf("%s: %s: no summary", tc.name, tc.files[i].name)
+				continue
+			}
+			if (summary{got.rows, got.skipped, got.overlap}) != want {
+				t.Errorf("%s: %s: %d rows, %d skipped, %d overlapping, expected %d, %d and %d", tc.name, tc.files[i].name,
+					got.rows, got.skipped, got.overlap, want.rows, want.skipped, want.overlap)
+			}
+		}
+	}
+}
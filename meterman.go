@@ -0,0 +1,55 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Reading of recent readings from a running MeterMan, so that the
+// last few hours can be topped up without waiting for the daily CSV file.
+// The URL must return the readings as CSV, in the same format as the
+// daily files (a header line with the date, time and column names).
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+var meterMan = flag.String("meterman", "", "URL of a running MeterMan returning its recent readings as CSV")
+
+// readLive fetches the recent readings, using only those after the
+// readings already read from the files.
+func (j *job) readLive() (*fileSummary, error) {
+	var after time.Time
+	for _, m := range j.manifest {
+		if m.last.After(after) {
+			after = m.last
+		}
+	}
+	client := http.Client{Timeout: time.Second * 30}
+	resp, err := client.Get(j.live)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	var in io.Reader = resp.Body
+	if *maxSize > 0 {
+		in = io.LimitReader(in, *maxSize*1024*1024)
+	}
+	return parseCSV(j.logger(), j.live, in, j.stats, j.location(), after, time.Time{})
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Notification of the run's completion to Home Assistant, either
+// via a webhook (which triggers an automation) or by calling a
+// notify service (e.g notify.persistent_notification) via the REST API.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var notifyWebhook = flag.String("notify-webhook", "", "Home Assistant webhook id called with a summary when the run completes")
+var notifyService = flag.String("notify-service", "", "Home Assistant notify service called with a summary when the run completes e.g notify.persistent_notification")
+
+// notifying returns true if a completion notification has been requested.
+func notifying() bool {
+	return *notifyWebhook != "" || *notifyService != ""
+}
+
+// notifyHA sends the run summary to Home Assistant.
+func notifyHA(success bool, summary string) error {
+	if *haURL == "" {
+		return fmt.Errorf("-ha-url is required for notifications")
+	}
+	base := strings.TrimSuffix(*haURL, "/")
+	title := "Backfill completed"
+	if !success {
+		title = "Backfill failed"
+	}
+	if *notifyWebhook != "" {
+		body := map[string]interface{}{"success": success, "title": title, "message": summary}
+		if err := postHA(base+"/api/webhook/"+*notifyWebhook, body); err != nil {
+			return err
+		}
+	}
+	if *notifyService != "" {
+		domain, service, ok := strings.Cut(*notifyService, ".")
+		if !ok {
+			return fmt.Errorf("%s: expected domain.service", *notifyService)
+		}
+		body := map[string]interface{}{"title": title, "message": summary}
+		if err := postHA(base+"/api/services/"+domain+"/"+service, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postHA posts the JSON body to the Home Assistant REST API.
+func postHA(url string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if *haToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*haToken)
+	}
+	client := http.Client{Timeout: time.Second * 30}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// runSummary returns a summary of the completed run.
+func runSummary(jobs []*job) string {
+	rows, skipped, errors := runTotals(jobs)
+	s := fmt.Sprintf("%s rows parsed, %s skipped, %s statistics records generated",
+		thousands(rows), thousands(skipped), thousands(recordCount))
+	if errors != 0 {
+		s += fmt.Sprintf(", %s files could not be read", thousands(errors))
+	}
+	return s
+}
+
+// fatalf logs the error and exits, notifying Home Assistant of the failure
+// if notifications have been requested.
+func fatalf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if notifying() {
+		if err := notifyHA(false, msg); err != nil {
+			log.Printf("notify: %v", err)
+		}
+	}
+	cleanup()
+	log.Fatal(msg)
+}
+
+// Functions called before exiting, such as removing temporary directories.
+var cleanups []func()
+
+// atExit registers a function to be called before exiting, whether main
+// returns or the run fails via fatalf or exit.
+func atExit(f func()) {
+	cleanups = append(cleanups, f)
+}
+
+// cleanup calls the registered functions, most recently registered first.
+func cleanup() {
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+	cleanups = nil
+}
+
+// exit cleans up and exits with the status code.
+func exit(code int) {
+	cleanup()
+	os.Exit(code)
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Handling of times with an explicit offset from UTC, either as a
+// timestamp in the date column (e.g 2023-01-01T10:00:00+10:00), or
+// as a time with an offset (e.g 10:00+10:00 or 00:00Z). The offset is
+// used for each row, so that files spanning a change of timezone, or
+// mixing UTC and local times, are read correctly.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Layouts of the times with offsets, after the date and time are joined with a T.
+var offsetLayouts = []string{
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04Z0700",
+	"2006-01-02T15:04:05Z0700",
+}
+
+// timestampDate returns true if the date includes a time of day.
+func timestampDate(date string) bool {
+	return len(date) > len("2006-01-02")
+}
+
+// parseOffset parses a date and time that include an offset from UTC,
+// returning the time in the location. If there is no offset, false is
+// returned, and the date and time are local times to be parsed by parseLocal.
+func parseOffset(date, clock string, loc *time.Location) (time.Time, bool, error) {
+	ts := date + "T" + clock
+	if timestampDate(date) {
+		// The time in the date column may be separated by a space or a T.
+		ts = date[:10] + "T" + date[11:]
+	}
+	if !hasOffset(ts) {
+		return time.Time{}, false, nil
+	}
+	for _, l := range offsetLayouts {
+		if t, err := time.Parse(l, ts); err == nil {
+			return t.In(loc), true, nil
+		}
+	}
+	return time.Time{}, true, fmt.Errorf("cannot parse time with offset")
+}
+
+// hasOffset returns true if there is an offset (or Z) after the hour and minute.
+func hasOffset(ts string) bool {
+	const minute = len("2006-01-02T15:04")
+	if len(ts) <= minute {
+		return false
+	}
+	return strings.HasSuffix(ts, "Z") || strings.ContainsAny(ts[minute:], "+-")
+}
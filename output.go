@@ -0,0 +1,77 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Output targets of the generated SQL. The same SQL may be written to
+// several files in one run e.g to apply to both the live database and a
+// test copy of it, or to keep a copy of the SQL piped to the database.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+var outputs sensorList
+
+func init() {
+	flag.Var(&outputs, "output", "File the generated SQL is written to, or - for standard output (may be repeated, default is standard output)")
+}
+
+// openOutputs directs the generated SQL to the -output targets,
+// returning a function that closes them once the SQL is flushed.
+func openOutputs() (func() error, error) {
+	var files []*os.File
+	closeAll := func() error {
+		var first error
+		for _, f := range files {
+			if err := f.Close(); err != nil && first == nil {
+				first = fmt.Errorf("%s: %v", f.Name(), err)
+			}
+		}
+		return first
+	}
+	var w []io.Writer
+	// When serving a preview, or applying the SQL directly, the SQL is kept
+	// to be downloaded or applied.
+	if *serve != "" || *applyDirect {
+		w = append(w, &servedSQL)
+	}
+	if len(outputs) == 0 && len(w) == 0 {
+		return closeAll, nil
+	}
+	seen := make(map[string]bool)
+	for _, o := range outputs {
+		if seen[o] {
+			closeAll()
+			return nil, fmt.Errorf("%s: duplicate output", o)
+		}
+		seen[o] = true
+		if o == "-" {
+			w = append(w, os.Stdout)
+			continue
+		}
+		f, err := os.Create(o)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		files = append(files, f)
+		w = append(w, f)
+	}
+	setOutput(io.MultiWriter(w...))
+	return closeAll, nil
+}
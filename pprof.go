@@ -0,0 +1,61 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// CPU and memory profiling, so that performance problems with
+// large archives can be diagnosed with go tool pprof.
+
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+var cpuProfile = flag.String("cpuprofile", "", "Write a CPU profile to this file")
+var memProfile = flag.String("memprofile", "", "Write a memory (heap) profile to this file on completion")
+
+// startProfiling starts the CPU profile if requested, returning
+// a function that stops it and writes the memory profile.
+func startProfiling() func() {
+	var cpu *os.File
+	if *cpuProfile != "" {
+		var err error
+		if cpu, err = os.Create(*cpuProfile); err != nil {
+			log.Fatalf("-cpuprofile %v", err)
+		}
+		if err := pprof.StartCPUProfile(cpu); err != nil {
+			log.Fatalf("-cpuprofile %v", err)
+		}
+	}
+	return func() {
+		if cpu != nil {
+			pprof.StopCPUProfile()
+			cpu.Close()
+		}
+		if *memProfile != "" {
+			f, err := os.Create(*memProfile)
+			if err != nil {
+				log.Fatalf("-memprofile %v", err)
+			}
+			defer f.Close()
+			runtime.GC()
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				log.Fatalf("-memprofile %v", err)
+			}
+		}
+	}
+}
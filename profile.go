@@ -0,0 +1,90 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Hourly profiles, used to distribute the energy between readings that
+// are far apart (such as daily meter reads) across the hours of the day.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var profileName = flag.String("profile", "flat", "Hourly profile for the profile resampling: flat, solar, load, or a file of 24 hourly weights")
+
+// Minimum gap between readings that is resampled using a profile.
+const profileGap = time.Hour * 25
+
+// A typical residential load shape, with morning and evening peaks.
+var loadProfile = []float64{
+	0.5, 0.4, 0.4, 0.4, 0.4, 0.5, 0.8, 1.2, 1.1, 0.9, 0.8, 0.8,
+	0.8, 0.8, 0.8, 0.9, 1.1, 1.5, 1.8, 1.7, 1.5, 1.2, 0.9, 0.7,
+}
+
+// readProfile returns the 24 hourly weights of the named profile.
+// A file contains the weights separated by commas or newlines.
+func readProfile(name string) ([]float64, error) {
+	p := make([]float64, 24)
+	switch name {
+	case "flat":
+		for h := range p {
+			p[h] = 1
+		}
+		return p, nil
+
+	case "solar":
+		// Half a sine wave from 6am to 6pm.
+		for h := 6; h < 18; h++ {
+			p[h] = math.Sin(math.Pi * (float64(h-6) + 0.5) / 12)
+		}
+		return p, nil
+
+	case "load":
+		copy(p, loadProfile)
+		return p, nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.FieldsFunc(string(data), func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r' || r == ' ' || r == '\t'
+	})
+	if len(fields) != 24 {
+		return nil, fmt.Errorf("%s: profile must have 24 hourly weights", name)
+	}
+	for h, f := range fields {
+		p[h], err = strconv.ParseFloat(f, 64)
+		if err != nil || p[h] < 0 {
+			return nil, fmt.Errorf("%s: invalid weight (%s)", name, f)
+		}
+	}
+	return p, nil
+}
+
+// profileWeight returns the total weight of the profile from a to b,
+// in steps of 5 minutes.
+func profileWeight(p []float64, a, b time.Time) float64 {
+	var w float64
+	for t := a; t.Before(b); t = t.Add(time.Minute * 5) {
+		w += p[t.Hour()]
+	}
+	return w
+}
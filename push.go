@@ -0,0 +1,79 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Pushing of the run metrics to a Prometheus Pushgateway.
+// Backfill runs are short-lived batch jobs that cannot be scraped,
+// so the metrics are pushed once the run has completed. The last
+// success time is only pushed by a successful run, so that alerts
+// can be raised if it becomes stale.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var pushGateway = flag.String("pushgateway", "", "URL of a Prometheus Pushgateway that the run metrics are pushed to")
+var pushJob = flag.String("pushgateway-job", "ha_backfill", "Job name of the metrics pushed to the Pushgateway")
+
+// runTotals returns the total rows parsed and skipped, and the
+// number of files that could not be read.
+func runTotals(jobs []*job) (rows, skipped, errors int) {
+	for _, j := range jobs {
+		for _, m := range j.manifest {
+			rows += m.rows
+			skipped += m.skipped
+		}
+		errors += j.errors
+	}
+	return rows, skipped, errors
+}
+
+// pushMetrics pushes the metrics of a completed run to the Pushgateway.
+func pushMetrics(jobs []*job, start time.Time) error {
+	var b bytes.Buffer
+	metric := func(name, help string, v float64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, v)
+	}
+	rows, skipped, errors := runTotals(jobs)
+	now := time.Now()
+	metric("backfill_duration_seconds", "Duration of the last run.", now.Sub(start).Seconds())
+	metric("backfill_rows_parsed", "CSV rows parsed in the last run.", float64(rows))
+	metric("backfill_rows_skipped", "CSV rows skipped in the last run.", float64(skipped))
+	metric("backfill_records", "Statistics records generated in the last run.", float64(recordCount))
+	metric("backfill_errors", "Files that could not be read in the last run.", float64(errors))
+	metric("backfill_last_success_timestamp_seconds", "Time of the last successful run.", float64(now.Unix()))
+	u := strings.TrimSuffix(*pushGateway, "/") + "/metrics/job/" + url.PathEscape(*pushJob)
+	req, err := http.NewRequest(http.MethodPut, u, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	client := http.Client{Timeout: time.Second * 30}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
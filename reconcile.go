@@ -0,0 +1,124 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Reconciliation of files that have changed since a previous run.
+// The manifest of the previous run is compared with the files read,
+// and only the records from the earliest change onwards are regenerated.
+// Later records are included because the sums accumulate, so a
+// correction changes every sum after it.
+
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+var reconcile = flag.String("reconcile", "", "Manifest of a previous run; only the records affected by files changed since then are regenerated")
+
+// A file in a previous manifest.
+type manifestEntry struct {
+	hash  string
+	first time.Time // Time of the first reading
+}
+
+// Previous manifest, indexed by job and file.
+var prevManifest map[[2]string]manifestEntry
+
+// readManifest reads a manifest written by writeManifest.
+func readManifest(file string) (map[[2]string]manifestEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	lines, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[[2]string]manifestEntry)
+	for i, l := range lines {
+		if len(l) != 6 {
+			return nil, fmt.Errorf("%d: expected job,file,sha256,rows,first,last", i+1)
+		}
+		e := manifestEntry{hash: l[2]}
+		if l[4] != "" {
+			if e.first, err = time.Parse(time.RFC3339, l[4]); err != nil {
+				return nil, fmt.Errorf("%d: %v", i+1, err)
+			}
+		}
+		m[[2]string{l[0], l[1]}] = e
+	}
+	return m, nil
+}
+
+// changedFrom returns the time of the earliest reading in the files that
+// have been added, changed or removed since the previous manifest,
+// or false if there are no changes.
+func (j *job) changedFrom() (time.Time, bool) {
+	var from time.Time
+	changed := false
+	earliest := func(t time.Time) {
+		changed = true
+		if !t.IsZero() && (from.IsZero() || t.Before(from)) {
+			from = t
+		}
+	}
+	read := make(map[string]bool)
+	for _, m := range j.manifest {
+		read[m.file] = true
+		prev, ok := prevManifest[[2]string{j.name, m.file}]
+		if ok && prev.hash == fmt.Sprintf("%x", m.hash) {
+			continue
+		}
+		earliest(m.first)
+		if ok {
+			earliest(prev.first)
+		}
+	}
+	for k, prev := range prevManifest {
+		if k[0] == j.name && !read[k[1]] {
+			earliest(prev.first)
+		}
+	}
+	return from, changed
+}
+
+// reconciled restricts the spans to the records affected by the changed
+// files, returning false if there are no changes. The record ending at
+// the earliest changed reading is included.
+func (j *job) reconciled(long, short *span) bool {
+	from, changed := j.changedFrom()
+	if !changed {
+		return false
+	}
+	// A change with no readings (e.g a file emptied) affects everything.
+	if from.IsZero() {
+		return true
+	}
+	from = from.Add(-time.Hour).In(time.UTC).Truncate(time.Hour)
+	if long.from.Before(from) {
+		long.from = from
+	}
+	if short.from.Before(from) {
+		short.from = from
+	}
+	long.partial, short.partial = true, true
+	return true
+}
@@ -0,0 +1,75 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Settings read from the Home Assistant recorder configuration.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var haConfig = flag.String("ha-config", "", "Home Assistant configuration.yaml, used to read the recorder purge_keep_days")
+
+// Number of days the recorder keeps short term statistics if not configured.
+const defaultPurgeKeepDays = 10
+
+// purgeKeepDays reads the recorder purge_keep_days setting from
+// the Home Assistant configuration file. Only the simple YAML
+// layout used in configuration.yaml is understood i.e
+//
+//	recorder:
+//	  purge_keep_days: 30
+//
+// If the setting is not present, the recorder default is returned.
+func purgeKeepDays(file string) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	inRecorder := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		// A non-indented line starts a new top level block.
+		if line[0] != ' ' && line[0] != '\t' {
+			inRecorder = strings.TrimSpace(line) == "recorder:"
+			continue
+		}
+		if !inRecorder {
+			continue
+		}
+		k, v, found := strings.Cut(strings.TrimSpace(line), ":")
+		if found && k == "purge_keep_days" {
+			days, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil || days <= 0 {
+				return 0, fmt.Errorf("invalid purge_keep_days (%s)", strings.TrimSpace(v))
+			}
+			return days, nil
+		}
+	}
+	return defaultPurgeKeepDays, scanner.Err()
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The report command, which prints the daily and monthly totals
+// of the accumulating statistics so that they can be cross-checked
+// (e.g against utility bills) before importing.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var reportCSV = flag.Bool("report-csv", false, "Write the report as CSV")
+
+// totals accumulates the energy of each statistic per period (day or month).
+type totals struct {
+	periods []string             // Periods, in time order
+	values  map[string][]float32 // Totals of each statistic per period
+}
+
+// add adds a value for statistic i of n to the period total.
+func (t *totals) add(period string, i, n int, v float32) {
+	if t.values == nil {
+		t.values = make(map[string][]float32)
+	}
+	if _, ok := t.values[period]; !ok {
+		t.periods = append(t.periods, period)
+		t.values[period] = make([]float32, n)
+	}
+	t.values[period][i] += v
+}
+
+// report reads the CSV files of the jobs, and prints the daily and
+// monthly totals of the accumulating statistics.
+func report(jobs []*job) {
+	for _, j := range jobs {
+		if _, err := j.read(context.Background()); err != nil {
+			fatalf("%v", err)
+		}
+		var stats []*stat
+		for _, s := range j.stats {
+			if !s.mean {
+				stats = append(stats, s)
+			}
+		}
+		var daily, monthly totals
+		for i, s := range stats {
+			for k, v := range s.values {
+				if k == 0 {
+					continue
+				}
+				// The increase is attributed to the period ending at the sample time.
+				t := v.t.Add(-time.Nanosecond)
+				inc := v.sum - s.values[k-1].sum
+				daily.add(t.Format("2006-01-02"), i, len(stats), inc)
+				monthly.add(t.Format("2006-01"), i, len(stats), inc)
+			}
+		}
+		header := []string{"period"}
+		for _, s := range stats {
+			header = append(header, s.name)
+		}
+		if *reportCSV {
+			w := csv.NewWriter(os.Stdout)
+			w.Write(append([]string{"#job"}, header...))
+			for _, t := range []*totals{&daily, &monthly} {
+				for _, p := range t.periods {
+					rec := []string{j.name, p}
+					for _, v := range t.values[p] {
+						rec = append(rec, fmt.Sprintf("%.3f", v))
+					}
+					w.Write(rec)
+				}
+			}
+			w.Flush()
+			continue
+		}
+		fmt.Printf("Job: %s\n", j.name)
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+		for _, t := range []*totals{&daily, &monthly} {
+			fmt.Fprintln(w)
+			for _, h := range header {
+				fmt.Fprintf(w, "%s\t", h)
+			}
+			fmt.Fprintln(w)
+			for _, p := range t.periods {
+				fmt.Fprintf(w, "%s\t", p)
+				for _, v := range t.values[p] {
+					fmt.Fprintf(w, "%.3f\t", v)
+				}
+				fmt.Fprintln(w)
+			}
+		}
+		w.Flush()
+	}
+}
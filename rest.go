@@ -0,0 +1,333 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// REST API of the preview server, so that the backfill can be driven by
+// other automation (e.g Node-RED or scripts). The data of a job may be
+// uploaded, or pointed at a directory within the job's configured
+// directory, which regenerates the statistics and the SQL; the statistics
+// may be previewed as JSON, and the SQL downloaded or applied to the database.
+//
+//	GET  /api/preview             Preview of the statistics
+//	GET  /api/sql                 The generated SQL
+//	POST /api/data?job=NAME       Upload CSV files (multipart, field "file"),
+//	                              or point at a directory ({"dir": "/path"})
+//	POST /api/apply               Apply the SQL to the database
+//	POST /api/run                 Submit a backfill task, as for the JSON-RPC
+//	                              Backfill.Submit ({"job": NAME, "dir": PATH, "apply": BOOL})
+//	GET  /api/task?task=N         State and messages of the task
+//	POST /api/cancel?task=N       Cancel the task
+//
+// The POST requests must give the -serve-token, if set.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Maximum size of the files uploaded in one request, in MB.
+const maxUpload = 1024
+
+// handleAPI adds the REST API handlers.
+func (p *preview) handleAPI(mux *http.ServeMux, b *Backfill) {
+	mux.HandleFunc("/api/preview", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		writeJSON(w, http.StatusOK, p)
+	})
+	mux.HandleFunc("/api/sql", p.sql)
+	mux.HandleFunc("/api/data", p.data)
+	mux.HandleFunc("/api/apply", func(w http.ResponseWriter, r *http.Request) {
+		if !applyAllowed(w, r) {
+			return
+		}
+		status := http.StatusOK
+		if !p.applyOnce(context.Background(), log.Default()) {
+			status = http.StatusInternalServerError
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		writeJSON(w, status, map[string]string{"applied": p.Applied})
+	})
+	mux.HandleFunc("/api/run", b.run)
+	mux.HandleFunc("/api/task", b.taskStatus)
+	mux.HandleFunc("/api/cancel", b.cancel)
+}
+
+// run submits a backfill task, returning its number.
+func (b *Backfill) run(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST required"})
+		return
+	}
+	if !isJSON(r) {
+		writeJSON(w, http.StatusUnsupportedMediaType, map[string]string{"error": "Content-Type application/json required"})
+		return
+	}
+	var args SubmitArgs
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if args.Apply && !applyAllowed(w, r) {
+		return
+	}
+	var task int
+	if err := b.Submit(args, &task); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"task": task})
+}
+
+// taskStatus returns the state and messages of a task, without waiting.
+func (b *Backfill) taskStatus(w http.ResponseWriter, r *http.Request) {
+	t, err := b.taskParam(r)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	writeJSON(w, http.StatusOK, t.progress(0))
+}
+
+// cancel cancels a task.
+func (b *Backfill) cancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST required"})
+		return
+	}
+	if !sameOrigin(w, r) {
+		return
+	}
+	t, err := b.taskParam(r)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	t.cancel()
+	writeJSON(w, http.StatusOK, map[string]bool{"cancelled": true})
+}
+
+// taskParam returns the task given by the request's task parameter.
+func (b *Backfill) taskParam(r *http.Request) (*rpcTask, error) {
+	n, err := strconv.Atoi(r.URL.Query().Get("task"))
+	if err != nil {
+		return nil, fmt.Errorf("task number required")
+	}
+	return b.task(n)
+}
+
+// data uploads the CSV files of a job, or points the job at a directory,
+// and regenerates the preview and the SQL.
+func (p *preview) data(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST required"})
+		return
+	}
+	if !sameOrigin(w, r) {
+		return
+	}
+	var dir string
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mt == "multipart/form-data" {
+		var err error
+		if dir, err = p.saveUpload(w, r); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	} else if mt != "application/json" {
+		writeJSON(w, http.StatusUnsupportedMediaType, map[string]string{"error": "Content-Type application/json or multipart/form-data required"})
+		return
+	} else {
+		var req struct {
+			Dir string `json:"dir"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Dir == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": `{"dir": "/path"} required`})
+			return
+		}
+		dir = req.Dir
+	}
+	if err := p.regenerate(context.Background(), log.Default(), r.URL.Query().Get("job"), dir); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	writeJSON(w, http.StatusOK, p)
+}
+
+// saveUpload saves the uploaded files in a new directory, replacing
+// any previously uploaded files.
+func (p *preview) saveUpload(w http.ResponseWriter, r *http.Request) (string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUpload<<20)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		return "", err
+	}
+	files := r.MultipartForm.File["file"]
+	if len(files) == 0 {
+		return "", fmt.Errorf("no files uploaded")
+	}
+	dir, err := os.MkdirTemp("", "ha-backfill-upload")
+	if err != nil {
+		return "", err
+	}
+	for _, fh := range files {
+		if err := saveFile(fh, dir); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	p.mu.Lock()
+	if p.upload != "" {
+		os.RemoveAll(p.upload)
+	}
+	p.upload = dir
+	p.mu.Unlock()
+	return dir, nil
+}
+
+// saveFile copies an uploaded file into the directory, using only its base name.
+func saveFile(fh *multipart.FileHeader, dir string) error {
+	in, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(filepath.Join(dir, filepath.Base(filepath.Clean("/"+fh.Filename))))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// isJSON returns true if the body of the request is JSON.
+func isJSON(r *http.Request) bool {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mt == "application/json"
+}
+
+// withinDir returns an error unless the directory is the job's configured
+// directory or one below it, so that clients cannot read any other files.
+func withinDir(dir, base string) error {
+	if base == "" {
+		return fmt.Errorf("%s: the job has no directory", dir)
+	}
+	d, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	b, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(b, d); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s: not within the job's directory %s", dir, base)
+	}
+	return nil
+}
+
+// Error returned if the regeneration is cancelled.
+var errCancelled = errors.New("cancelled")
+
+// regenerate reads the jobs again, with the named job (which may be
+// omitted if there is only one) reading the files in the directory,
+// which must be the uploaded files or within the job's directory,
+// and regenerates the SQL and the preview, with the messages of the jobs
+// logged to the logger. If the context is cancelled, the regeneration
+// stops at the next file or statistic. If the regeneration fails or is
+// cancelled, the preview and SQL are cleared.
+func (p *preview) regenerate(ctx context.Context, logger *log.Logger, name, dir string) error {
+	jobs, err := loadJobs()
+	if err != nil {
+		return err
+	}
+	var found *job
+	for _, j := range jobs {
+		j.log = logger
+		if j.name == name || (name == "" && len(jobs) == 1) {
+			found = j
+		}
+	}
+	if found == nil {
+		return fmt.Errorf("%s: unknown job", name)
+	}
+	// Reading a missing directory is fatal, so it is checked first.
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("%s: not a directory", dir)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if dir != p.upload {
+		if err := withinDir(dir, found.dir); err != nil {
+			return err
+		}
+	}
+	found.dir = dir
+	logger.Printf("preview: job %s reading %s", found.name, dir)
+	recordCount = 0
+	servedSQL.Reset()
+	setOutput(&servedSQL)
+	closeRollback, err := openRollback()
+	if err != nil {
+		return err
+	}
+	err = generate(ctx, jobs, p.long, p.short)
+	if cerr := closeRollback(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = sqlOut.Flush()
+	}
+	if err == nil {
+		err = p.update(jobs)
+	}
+	if err != nil {
+		recordCount = 0
+		servedSQL.Reset()
+		p.update(nil)
+		if ctx.Err() != nil {
+			return errCancelled
+		}
+		return err
+	}
+	return nil
+}
+
+// writeJSON writes the value as the JSON response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("api: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Only the job's directory, and those below it, may be read via the API.
+func TestWithinDir(t *testing.T) {
+	base := t.TempDir()
+	other := t.TempDir()
+	for _, d := range []string{"sub", "sub/deeper", "..data"} {
+		if err := os.MkdirAll(filepath.Join(base, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(other, filepath.Join(base, "link")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dir  string
+		base string
+		ok   bool
+	}{
+		{base, base, true},
+		{filepath.Join(base, "sub"), base, true},
+		{filepath.Join(base, "sub/deeper"), base, true},
+		{filepath.Join(base, "..data"), base, true},
+		{filepath.Join(base, "sub/../.."), base, false},
+		{filepath.Join(base, "link"), base, false},
+		{other, base, false},
+		{"/", base, false},
+		{base, "", false},
+	}
+	for _, tc := range tests {
+		if err := withinDir(tc.dir, tc.base); (err == nil) != tc.ok {
+			t.Errorf("%s within %q: got %v, expected ok %v", tc.dir, tc.base, err, tc.ok)
+		}
+	}
+}
+
+// Requests that change the preview or its tasks are refused from the pages of other sites.
+func TestCrossOrigin(t *testing.T) {
+	p := &preview{}
+	b := &Backfill{p: p}
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		url     string
+		ctype   string
+		origin  string
+		status  int
+	}{
+		{"data", p.data, "/api/data", "multipart/form-data; boundary=x", "http://evil.example", http.StatusForbidden},
+		{"data form", p.data, "/api/data", "application/x-www-form-urlencoded", "http://evil.example", http.StatusForbidden},
+		{"cancel", b.cancel, "/api/cancel?task=1", "", "http://evil.example", http.StatusForbidden},
+		{"cancel same origin", b.cancel, "/api/cancel?task=1", "", "http://example.com", http.StatusNotFound},
+		{"cancel no origin", b.cancel, "/api/cancel?task=1", "", "", http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodPost, tc.url, strings.NewReader(""))
+		if tc.ctype != "" {
+			r.Header.Set("Content-Type", tc.ctype)
+		}
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		w := httptest.NewRecorder()
+		tc.handler(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: status %d, expected %d", tc.name, w.Code, tc.status)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Interactive review of the samples read, before any SQL is generated.
+// The samples of each statistic may be browsed by month and day, the
+// detected meter resets and gaps in the readings listed, and months,
+// days or other periods excluded from the import. The existing records
+// of excluded periods are left unchanged.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var review = flag.Bool("review", false, "Interactively review the samples of each job, and select the periods imported, before generating the SQL")
+
+// Help for the review commands.
+const reviewHelp = `Commands:
+  list               List the statistics
+  stat NAME|N        Select a statistic
+  months             Monthly summary of the selected statistic
+  days YYYY-MM       Daily summary of the month
+  resets [YYYY-MM]   Meter resets detected
+  gaps [YYYY-MM]     Gaps in the readings longer than -resample-max-gap
+  skip PERIOD        Exclude a period (YYYY-MM, YYYY-MM-DD or FROM,TO) from the import
+  keep PERIOD        Include an excluded period again
+  done               Generate the SQL
+  quit               Stop without generating the SQL
+`
+
+// Input of the review commands, shared by all the jobs.
+var reviewIn *bufio.Scanner
+
+// Summary of the samples of a statistic in one month or day.
+type reviewPeriod struct {
+	span
+	name    string
+	samples int
+	first   sample
+	last    sample
+	resets  int
+	gaps    int
+}
+
+// review runs the interactive review of the job's statistics, returning
+// an error if it is stopped without generating the SQL.
+func (j *job) review() error {
+	if reviewIn == nil {
+		reviewIn = bufio.NewScanner(os.Stdin)
+	}
+	out := os.Stderr
+	var sel *stat
+	if len(j.stats) > 0 {
+		sel = j.stats[0]
+	}
+	fmt.Fprintf(out, "Reviewing job %s (type help for the commands)\n", j.name)
+	j.listStats(out)
+	for {
+		if sel != nil {
+			fmt.Fprintf(out, "%s/%s> ", j.name, sel.name)
+		} else {
+			fmt.Fprintf(out, "%s> ", j.name)
+		}
+		if !reviewIn.Scan() {
+			return errors.New("review: no more input, stopped")
+		}
+		args := strings.Fields(reviewIn.Text())
+		if len(args) == 0 {
+			continue
+		}
+		// Dates may include a time e.g 2023-01-15 10:00,2023-01-16
+		arg := strings.Join(args[1:], " ")
+		if args[0] != "list" && args[0] != "stat" && args[0] != "done" && args[0] != "quit" && args[0] != "help" && sel == nil {
+			fmt.Fprintln(out, "no statistic selected")
+			continue
+		}
+		switch args[0] {
+		case "help", "?":
+			fmt.Fprint(out, reviewHelp)
+		case "list":
+			j.listStats(out)
+		case "stat":
+			if s := j.findStat(arg); s != nil {
+				sel = s
+			} else {
+				fmt.Fprintf(out, "%s: unknown statistic\n", arg)
+			}
+		case "months":
+			sel.listPeriods(out, sel.periods(monthStart, "2006-01", span{}))
+		case "days":
+			sp, err := monthSpan(arg)
+			if err != nil {
+				fmt.Fprintln(out, err)
+				continue
+			}
+			sel.listPeriods(out, sel.periods(dayStart, "2006-01-02", sp))
+		case "resets", "gaps":
+			var sp span
+			if arg != "" {
+				var err error
+				if sp, err = monthSpan(arg); err != nil {
+					fmt.Fprintln(out, err)
+					continue
+				}
+			}
+			sel.listEvents(out, args[0] == "resets", sp)
+		case "skip", "keep":
+			sp, err := reviewSpan(arg)
+			if err != nil {
+				fmt.Fprintln(out, err)
+				continue
+			}
+			if args[0] == "skip" {
+				sel.skip = append(subtractSpan(sel.skip, sp), sp)
+				sort.Slice(sel.skip, func(a, b int) bool { return sel.skip[a].from.Before(sel.skip[b].from) })
+			} else {
+				sel.skip = subtractSpan(sel.skip, sp)
+			}
+			sel.listSkipped(out)
+		case "done":
+			for _, s := range j.stats {
+				if len(s.skip) != 0 {
+					log.Printf("%s: %d period(s) excluded from the import", s.name, len(s.skip))
+				}
+			}
+			return nil
+		case "quit":
+			return errors.New("review: stopped, no SQL generated")
+		default:
+			fmt.Fprintf(out, "%s: unknown command (type help for the commands)\n", args[0])
+		}
+	}
+}
+
+// listStats lists the statistics of the job.
+func (j *job) listStats(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "N\tSTATISTIC\tSAMPLES\tFROM\tTO\tEXCLUDED")
+	for i, s := range j.stats {
+		from, to := "-", "-"
+		if n := len(s.values); n != 0 {
+			from, to = s.values[0].t.In(csvLoc).Format(tFmt), s.values[n-1].t.In(csvLoc).Format(tFmt)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\n", i+1, s.name, thousands(len(s.values)), from, to, len(s.skip))
+	}
+	w.Flush()
+}
+
+// findStat returns the statistic with the name or number.
+func (j *job) findStat(arg string) *stat {
+	if n, err := strconv.Atoi(arg); err == nil && n >= 1 && n <= len(j.stats) {
+		return j.stats[n-1]
+	}
+	for _, s := range j.stats {
+		if s.name == arg {
+			return s
+		}
+	}
+	return nil
+}
+
+// monthStart and dayStart return the start of the month or day containing t, and the next one.
+func monthStart(t time.Time) (time.Time, time.Time) {
+	t = t.In(csvLoc)
+	m := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, csvLoc)
+	return m, m.AddDate(0, 1, 0)
+}
+
+func dayStart(t time.Time) (time.Time, time.Time) {
+	t = t.In(csvLoc)
+	d := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, csvLoc)
+	return d, d.AddDate(0, 0, 1)
+}
+
+// monthSpan parses a YYYY-MM month.
+func monthSpan(arg string) (span, error) {
+	t, err := time.ParseInLocation("2006-01", arg, csvLoc)
+	if err != nil {
+		return span{}, fmt.Errorf("%s: invalid month (YYYY-MM)", arg)
+	}
+	return span{from: t, to: t.AddDate(0, 1, 0)}, nil
+}
+
+// reviewSpan parses a period, which is a month, a day, or FROM,TO dates.
+func reviewSpan(arg string) (span, error) {
+	if from, to, ok := strings.Cut(arg, ","); ok {
+		var sp span
+		var err error
+		if sp.from, err = parseDate(from); err != nil {
+			return sp, err
+		}
+		if sp.to, err = parseDate(to); err != nil {
+			return sp, err
+		}
+		if !sp.to.After(sp.from) {
+			return sp, fmt.Errorf("%s: empty period", arg)
+		}
+		return sp, nil
+	}
+	if sp, err := monthSpan(arg); err == nil {
+		return sp, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", arg, csvLoc)
+	if err != nil {
+		return span{}, fmt.Errorf("%s: invalid period (YYYY-MM, YYYY-MM-DD or FROM,TO)", arg)
+	}
+	return span{from: t, to: t.AddDate(0, 0, 1)}, nil
+}
+
+// subtractSpan removes the span from the list of spans.
+func subtractSpan(list []span, r span) []span {
+	var res []span
+	for _, sp := range list {
+		if !sp.to.After(r.from) || !r.to.After(sp.from) {
+			res = append(res, sp)
+			continue
+		}
+		if sp.from.Before(r.from) {
+			res = append(res, span{from: sp.from, to: r.from})
+		}
+		if r.to.Before(sp.to) {
+			res = append(res, span{from: r.to, to: sp.to})
+		}
+	}
+	return res
+}
+
+// periods summarizes the samples within the span, per month or day,
+// named using the layout.
+func (s *stat) periods(bounds func(time.Time) (time.Time, time.Time), layout string, sp span) []*reviewPeriod {
+	var ps []*reviewPeriod
+	var p *reviewPeriod
+	for i, v := range s.values {
+		if !sp.contains(v.t) {
+			continue
+		}
+		if p == nil || !p.contains(v.t) {
+			from, to := bounds(v.t)
+			p = &reviewPeriod{span: span{from: from, to: to}, name: from.Format(layout), first: v}
+			ps = append(ps, p)
+		}
+		p.samples++
+		p.last = v
+		if i > 0 {
+			prev := s.values[i-1]
+			if !s.mean && !v.reset.Equal(prev.reset) {
+				p.resets++
+			}
+			if v.t.Sub(prev.t) > *resampleGap {
+				p.gaps++
+			}
+		}
+	}
+	return ps
+}
+
+// listPeriods lists the summaries of the periods, with whether they are excluded.
+func (s *stat) listPeriods(out io.Writer, ps []*reviewPeriod) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	total := "TOTAL"
+	if s.mean {
+		total = "MIN/MAX"
+	}
+	fmt.Fprintf(w, "PERIOD\tSAMPLES\tFIRST\tLAST\t%s\tRESETS\tGAPS\tIMPORT\n", total)
+	for _, p := range ps {
+		var value string
+		if s.mean {
+			min, max := p.first.value, p.first.value
+			for _, v := range s.values {
+				if p.contains(v.t) {
+					if v.value < min {
+						min = v.value
+					}
+					if v.value > max {
+						max = v.value
+					}
+				}
+			}
+			value = fmt.Sprintf("%s / %s", humanQuantity(float64(min), s.unit), humanQuantity(float64(max), s.unit))
+		} else {
+			value = humanQuantity(float64(p.last.sum-p.first.sum), s.unit)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%d\t%d\t%s\n", p.name, p.samples, p.first.t.In(csvLoc).Format("01-02 15:04"),
+			p.last.t.In(csvLoc).Format("01-02 15:04"), value, p.resets, p.gaps, s.imported(p.span))
+	}
+	w.Flush()
+}
+
+// imported returns whether the period is imported, excluded or partly excluded.
+func (s *stat) imported(p span) string {
+	left := []span{p}
+	for _, sk := range s.skip {
+		left = subtractSpan(left, sk)
+	}
+	switch {
+	case len(left) == 0:
+		return "no"
+	case len(left) == 1 && left[0].from.Equal(p.from) && left[0].to.Equal(p.to):
+		return "yes"
+	}
+	return "partly"
+}
+
+// A meter reset, or a gap in the readings.
+type event struct {
+	from, to time.Time // Prior sample, and the sample after the gap or reset
+	sum      float32   // Sum before the reset
+	src      source    // Source of the sample after the gap or reset
+}
+
+// events returns the resets or the gaps within the span.
+func (s *stat) events(resets bool, sp span) []event {
+	var evs []event
+	for i := 1; i < len(s.values); i++ {
+		v, prev := s.values[i], s.values[i-1]
+		if !sp.contains(v.t) {
+			continue
+		}
+		if (resets && !s.mean && !v.reset.Equal(prev.reset)) || (!resets && v.t.Sub(prev.t) > *resampleGap) {
+			evs = append(evs, event{from: prev.t, to: v.t, sum: prev.sum, src: v.src})
+		}
+	}
+	return evs
+}
+
+// listEvents lists the resets or the gaps within the span, with the source of the sample.
+func (s *stat) listEvents(out io.Writer, resets bool, sp span) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	if resets {
+		fmt.Fprintln(w, "TIME\tSUM BEFORE\tSOURCE")
+	} else {
+		fmt.Fprintln(w, "FROM\tTO\tLENGTH\tSOURCE")
+	}
+	for _, e := range s.events(resets, sp) {
+		if resets {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", e.to.In(csvLoc).Format(tFmt), humanQuantity(float64(e.sum), s.unit), e.src)
+		} else {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.from.In(csvLoc).Format(tFmt), e.to.In(csvLoc).Format(tFmt),
+				humanDuration(e.to.Sub(e.from)), e.src)
+		}
+	}
+	w.Flush()
+}
+
+// listSkipped lists the periods excluded from the import.
+func (s *stat) listSkipped(out io.Writer) {
+	if len(s.skip) == 0 {
+		fmt.Fprintf(out, "%s: all periods imported\n", s.name)
+		return
+	}
+	for _, sp := range s.skip {
+		fmt.Fprintf(out, "%s: excluded %s to %s\n", s.name, sp.from.In(csvLoc).Format(tFmt), sp.to.In(csvLoc).Format(tFmt))
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Rollback of an import. Alongside the generated SQL, SQL is generated
+// that undoes the import: the records in the periods that the import
+// replaces (or merges into) are removed, and the records that exist
+// before the import are inserted again, so that applying it restores
+// the tables, and any statistics_meta records the import adds are removed.
+// The existing records are read from the database, so without one the
+// rollback can only remove the imported records.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+var rollbackFile = flag.String("rollback", "", "File to write the SQL that undoes the import (restoring the replaced records requires -db or -database)")
+
+// Writer of the rollback SQL, if any.
+var rollbackOut *bufio.Writer
+
+// openRollback creates the rollback file, returning a function that
+// completes and closes it once the SQL has been generated. If journalling,
+// the rollback is also kept for the journal.
+func openRollback() (func() error, error) {
+	journalRollback.Reset()
+	if *rollbackFile == "" && *journalFile == "" {
+		return func() error { return nil }, nil
+	}
+	var f *os.File
+	var w io.Writer = &journalRollback
+	if *rollbackFile != "" {
+		var err error
+		if f, err = os.Create(*rollbackFile); err != nil {
+			return nil, err
+		}
+		if db == nil {
+			log.Printf("%s: warning: without -db or -database, the rollback only removes the imported records", *rollbackFile)
+		}
+		w = f
+		if *journalFile != "" {
+			w = io.MultiWriter(f, &journalRollback)
+		}
+	}
+	rollbackOut = bufio.NewWriterSize(w, 64*1024)
+	fmt.Fprintf(rollbackOut, "-- Rollback generated by ha-backfill %s\n", version)
+	fmt.Fprintf(rollbackOut, "-- Generated at: %s\n", time.Now().Format(time.RFC3339))
+	if *transaction {
+		fmt.Fprintln(rollbackOut, "BEGIN;")
+	}
+	return func() error {
+		journalRollbackSQL()
+		if *transaction {
+			fmt.Fprintln(rollbackOut, "COMMIT;")
+		}
+		err := rollbackOut.Flush()
+		rollbackOut = nil
+		if f == nil {
+			return err
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", *rollbackFile, err)
+		}
+		return nil
+	}, nil
+}
+
+// rollbackSQL generates the SQL to restore the statistic's records in
+// the table within the span (and outside its skipped periods).
+func (s *stat) rollbackSQL(table string, sp span) error {
+	if rollbackOut == nil {
+		return nil
+	}
+	fmt.Fprintf(rollbackOut, "DELETE FROM %s WHERE %s = %s%s;\n", quoteIdent(table), quoteIdent("metadata_id"), s.keySQL(), sp.where())
+	if db == nil || s.key == 0 {
+		return nil
+	}
+	cols := recordColumns()
+	recs, err := existingRows(db, table, s.key, sp.where(), cols)
+	if err != nil {
+		return fmt.Errorf("%s: %v", table, err)
+	}
+	for _, r := range recs {
+		fmt.Fprintf(rollbackOut, "INSERT INTO %s (%s) VALUES (%s);\n", quoteIdent(table), quoteIdents(cols...), strings.Join(r, ", "))
+	}
+	return nil
+}
+
+// rollbackMetaSQL generates the SQL to remove the statistics_meta record
+// that the import adds for a statistic identified only by its statistic_id.
+// Without the database, the record may have existed before the import,
+// so it is kept.
+func (s *stat) rollbackMetaSQL() {
+	if rollbackOut == nil || db == nil {
+		return
+	}
+	fmt.Fprintf(rollbackOut, "DELETE FROM %s WHERE %s = %s;\n", quoteIdent(metaName()), quoteIdent("statistic_id"), sqlQuote(s.id))
+}
+
+// rollbackOffset generates the SQL to remove an offset added to the sums
+// of the existing records from the start time.
+func (s *stat) rollbackOffset(table string, offset float64, start time.Time) {
+	if rollbackOut == nil {
+		return
+	}
+	sum := quoteIdent("sum")
+	fmt.Fprintf(rollbackOut, "UPDATE %s SET %s = %s - %f WHERE %s = %s AND %s >= %s;\n",
+		quoteIdent(table), sum, sum, offset, quoteIdent("metadata_id"), s.keySQL(), quoteIdent(startCol()), timeValue(start))
+}
@@ -0,0 +1,278 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// JSON-RPC interface of the preview server, so that other services
+// (e.g MeterMan) can orchestrate backfills without running this command.
+// Backfills are submitted as tasks, which are run one at a time, and
+// whose progress (the messages logged while running) can be followed,
+// and which can be cancelled. The interface is JSON-RPC 1.0 over TCP, as
+// implemented by net/rpc/jsonrpc, only on a loopback address since it has
+// no token, with the methods:
+//
+//	Backfill.Submit    {"job": NAME, "dir": PATH, "apply": BOOL} -> task number
+//	Backfill.Progress  {"task": N, "from": N} -> {"state": STATE, "events": [...], "next": N}
+//	Backfill.Cancel    {"task": N} -> true
+//
+// Progress waits for up to -rpc-wait for events after "from", so that
+// calling it repeatedly with "from" set to the previous "next" streams the events.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+var rpcAddr = flag.String("rpc", "", "Address of the JSON-RPC interface of the preview server e.g localhost:8081 (requires -serve, and must be a loopback address)")
+var rpcWait = flag.Duration("rpc-wait", 30*time.Second, "Maximum time a JSON-RPC progress call waits for new events")
+
+// States of a task
+const (
+	taskQueued    = "queued"
+	taskRunning   = "running"
+	taskDone      = "done"
+	taskFailed    = "failed"
+	taskCancelled = "cancelled"
+)
+
+// Backfill is the JSON-RPC service.
+type Backfill struct {
+	p     *preview
+	mu    sync.Mutex
+	tasks []*rpcTask // Tasks by number (from 1)
+	queue chan *rpcTask
+}
+
+// SubmitArgs are the arguments of a Submit call.
+type SubmitArgs struct {
+	Job   string `json:"job"`   // Name of the job (may be omitted if there is only one)
+	Dir   string `json:"dir"`   // Directory of the CSV files of the job
+	Apply bool   `json:"apply"` // Apply the SQL to the database once generated
+}
+
+// TaskArgs are the arguments of Progress and Cancel calls.
+type TaskArgs struct {
+	Task int `json:"task"` // Task number
+	From int `json:"from"` // Number of the first event returned by Progress
+}
+
+// ProgressReply is the reply to a Progress call.
+type ProgressReply struct {
+	State  string   `json:"state"`
+	Error  string   `json:"error,omitempty"`
+	Events []string `json:"events"`
+	Next   int      `json:"next"` // Number of the next event
+}
+
+// A backfill task.
+type rpcTask struct {
+	number  int
+	args    SubmitArgs
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	state   string
+	err     error
+	events  []string
+	changed chan struct{} // Closed when the task changes
+}
+
+// newBackfill creates the service, and starts running the tasks submitted to it.
+func newBackfill(p *preview) *Backfill {
+	b := &Backfill{p: p, queue: make(chan *rpcTask, 100)}
+	go b.worker()
+	return b
+}
+
+// runRPC serves the JSON-RPC interface until the process is stopped.
+func runRPC(b *Backfill) {
+	srv := rpc.NewServer()
+	if err := srv.Register(b); err != nil {
+		log.Fatalf("rpc: %v", err)
+	}
+	l, err := net.Listen("tcp", *rpcAddr)
+	if err != nil {
+		log.Fatalf("rpc: %v", err)
+	}
+	log.Printf("serving JSON-RPC on %s", *rpcAddr)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatalf("rpc: %v", err)
+		}
+		go srv.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
+
+// Submit queues a backfill task, returning its number.
+func (b *Backfill) Submit(args SubmitArgs, task *int) error {
+	if args.Dir == "" {
+		return errors.New("dir required")
+	}
+	if args.Apply && db == nil {
+		return errors.New("apply requires -db or -database")
+	}
+	t := &rpcTask{args: args, state: taskQueued, changed: make(chan struct{})}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case b.queue <- t:
+	default:
+		return errors.New("too many tasks queued")
+	}
+	b.tasks = append(b.tasks, t)
+	*task = len(b.tasks)
+	t.number = *task
+	publishTask(t)
+	return nil
+}
+
+// Progress returns the task's state and its events from args.From,
+// waiting for new events if there are none yet and the task is not finished.
+func (b *Backfill) Progress(args TaskArgs, reply *ProgressReply) error {
+	t, err := b.task(args.Task)
+	if err != nil {
+		return err
+	}
+	if args.From < 0 {
+		args.From = 0
+	}
+	timeout := time.After(*rpcWait)
+	for {
+		t.mu.Lock()
+		if len(t.events) > args.From || t.finished() {
+			*reply = t.progress(args.From)
+			t.mu.Unlock()
+			return nil
+		}
+		changed := t.changed
+		t.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+			t.mu.Lock()
+			reply.State, reply.Next, reply.Events = t.state, args.From, []string{}
+			t.mu.Unlock()
+			return nil
+		}
+	}
+}
+
+// Cancel cancels the task, which stops it at the next file or statistic
+// if it is running, rolling back any SQL being applied.
+func (b *Backfill) Cancel(args TaskArgs, ok *bool) error {
+	t, err := b.task(args.Task)
+	if err != nil {
+		return err
+	}
+	t.cancel()
+	*ok = true
+	return nil
+}
+
+// task returns the numbered task.
+func (b *Backfill) task(n int) (*rpcTask, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n < 1 || n > len(b.tasks) {
+		return nil, fmt.Errorf("%d: unknown task", n)
+	}
+	return b.tasks[n-1], nil
+}
+
+// worker runs the queued tasks one at a time, with the messages logged
+// by each added to its events as well as to the standard logger.
+func (b *Backfill) worker() {
+	for t := range b.queue {
+		if t.ctx.Err() != nil {
+			t.finish(errCancelled)
+			publishTask(t)
+			continue
+		}
+		t.update(func() { t.state = taskRunning })
+		publishTask(t)
+		logger := log.New(io.MultiWriter(log.Writer(), taskLog{t}), log.Prefix(), log.Flags())
+		err := b.p.regenerate(t.ctx, logger, t.args.Job, t.args.Dir)
+		if err == nil && t.args.Apply {
+			if !b.p.applyOnce(t.ctx, logger) {
+				b.p.mu.Lock()
+				err = errors.New(b.p.Applied)
+				b.p.mu.Unlock()
+			}
+		}
+		t.finish(err)
+		publishTask(t)
+	}
+}
+
+// finish sets the final state of the task.
+func (t *rpcTask) finish(err error) {
+	t.update(func() {
+		t.state, t.err = taskDone, err
+		if errors.Is(err, errCancelled) || (err != nil && t.ctx.Err() != nil) {
+			t.state = taskCancelled
+		} else if err != nil {
+			t.state = taskFailed
+		}
+	})
+	t.cancel()
+}
+
+// progress returns the task's state and its events from the numbered event.
+// The task must be locked.
+func (t *rpcTask) progress(from int) ProgressReply {
+	reply := ProgressReply{State: t.state, Events: []string{}, Next: len(t.events)}
+	if from < len(t.events) {
+		reply.Events = append(reply.Events, t.events[from:]...)
+	}
+	if t.err != nil {
+		reply.Error = t.err.Error()
+	}
+	return reply
+}
+
+// finished returns true if the task has finished.
+func (t *rpcTask) finished() bool {
+	return t.state != taskQueued && t.state != taskRunning
+}
+
+// update changes the task, and wakes any Progress calls waiting for it.
+func (t *rpcTask) update(f func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f()
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+// taskLog adds each message logged to the task's events.
+type taskLog struct {
+	t *rpcTask
+}
+
+func (l taskLog) Write(p []byte) (int, error) {
+	l.t.update(func() { l.t.events = append(l.t.events, strings.TrimSuffix(string(p), "\n")) })
+	return len(p), nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Secrets, so that the database password and access token need not appear
+// on the command line (where they are visible in ps or cron logs).
+// The database URL, Home Assistant URL and token, and the preview server's
+// token, may refer to a value in a Home Assistant secrets.yaml file as
+// '!secret NAME', and the database password and token may be prompted for,
+// or read from standard input.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+var secretsFile = flag.String("secrets", "", "Home Assistant secrets.yaml file of the values referred to as '!secret NAME' (defaults to secrets.yaml alongside -ha-config)")
+var prompt = flag.String("prompt", "", "Credentials to prompt for, or read from standard input: db-password, ha-token or both, comma separated")
+
+// Prefix of a reference to a secret.
+const secretPrefix = "!secret "
+
+// Database password, if prompted for.
+var dbPassword string
+
+// Secrets read from the secrets file, when first needed.
+var secrets map[string]string
+
+// resolveSecrets replaces any references to secrets in the credentials,
+// and prompts for the credentials selected via -prompt.
+func resolveSecrets() error {
+	for _, p := range []*string{database, haURL, haToken, serveToken} {
+		v, err := secret(*p)
+		if err != nil {
+			return err
+		}
+		*p = v
+	}
+	if *prompt == "" {
+		return nil
+	}
+	in := bufio.NewReader(os.Stdin)
+	for _, c := range strings.Split(*prompt, ",") {
+		var err error
+		switch strings.TrimSpace(c) {
+		case "db-password":
+			dbPassword, err = readSecret(in, "Database password: ")
+		case "ha-token":
+			*haToken, err = readSecret(in, "Home Assistant access token: ")
+		default:
+			return fmt.Errorf("-prompt %s: unknown credential", c)
+		}
+		if err != nil {
+			return fmt.Errorf("-prompt %s: %v", c, err)
+		}
+	}
+	return nil
+}
+
+// secret returns the value of the secret if the value refers to one,
+// otherwise the value itself.
+func secret(v string) (string, error) {
+	if !strings.HasPrefix(v, secretPrefix) {
+		return v, nil
+	}
+	name := strings.TrimSpace(strings.TrimPrefix(v, secretPrefix))
+	if secrets == nil {
+		file := *secretsFile
+		if file == "" && *haConfig != "" {
+			file = filepath.Join(filepath.Dir(*haConfig), "secrets.yaml")
+		}
+		if file == "" {
+			return "", fmt.Errorf("%s: no secrets file (set -secrets)", name)
+		}
+		var err error
+		if secrets, err = readSecrets(file); err != nil {
+			return "", fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	s, ok := secrets[name]
+	if !ok {
+		return "", fmt.Errorf("%s: secret not found", name)
+	}
+	return s, nil
+}
+
+// readSecrets reads a secrets file, which has one NAME: VALUE line per secret.
+// Blank lines and comments are ignored.
+func readSecrets(file string) (map[string]string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		log.Printf("%s: warning: secrets file is accessible by other users", file)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	s := make(map[string]string)
+	for i, l := range strings.Split(string(data), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		k, v, found := strings.Cut(l, ":")
+		if !found {
+			return nil, fmt.Errorf("%d: expected NAME: VALUE", i+1)
+		}
+		v = strings.TrimSpace(v)
+		// Quoted values may contain '#', otherwise it starts a comment.
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		} else if c := strings.Index(v, " #"); c >= 0 {
+			v = strings.TrimSpace(v[:c])
+		}
+		s[strings.TrimSpace(k)] = v
+	}
+	return s, nil
+}
+
+// readSecret prompts for a secret on the terminal without echoing it,
+// or if standard input is not a terminal, reads the next line.
+func readSecret(in *bufio.Reader, prompt string) (string, error) {
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+	l, err := in.ReadString('\n')
+	l = strings.TrimRight(l, "\r\n")
+	if l == "" && err != nil {
+		return "", err
+	}
+	return l, nil
+}
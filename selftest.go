@@ -0,0 +1,166 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The selftest command, which runs a small built-in dataset through
+// the full pipeline into a scratch SQLite database with the Home Assistant
+// schema, and verifies the resulting rows. This confirms the build and
+// the schema assumptions before any real data is touched.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Statistic_id of the self test statistic.
+const selftestId = "sensor.selftest_import"
+
+// selftest runs the self test, exiting with an error if it fails.
+func selftest() {
+	dir, err := os.MkdirTemp("", "ha-backfill-selftest")
+	if err != nil {
+		log.Fatalf("selftest: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := runSelftest(dir); err != nil {
+		os.RemoveAll(dir)
+		log.Fatalf("selftest: FAILED: %v", err)
+	}
+	fmt.Println("selftest: OK")
+}
+
+// runSelftest writes the dataset and creates the database in the directory,
+// then generates and applies the SQL, and checks the records.
+func runSelftest(dir string) error {
+	// Two hours of 5 minute readings, increasing by 0.1 kWh per reading.
+	csvDir := filepath.Join(dir, "csv")
+	if err := os.Mkdir(csvDir, 0755); err != nil {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString("Date,Time,IMP\n")
+	base := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= 24; i++ {
+		t := base.Add(time.Minute * 5 * time.Duration(i))
+		fmt.Fprintf(&b, "%s,%s,%.1f\n", t.Format("2006-01-02"), t.Format("15:04"), 100+float64(i)/10)
+	}
+	if err := os.WriteFile(filepath.Join(csvDir, "2022-04-01.csv"), []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	d, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, "selftest.db"))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := createSchema(d); err != nil {
+		return fmt.Errorf("creating schema: %v", err)
+	}
+	// Generate the SQL for the dataset.
+	j := &job{name: "selftest", dir: csvDir,
+		stats: []*stat{{name: "import", column: "IMP", id: selftestId, unit: "kWh", scale: 1}}}
+	savedLoc := csvLoc
+	csvLoc = time.UTC
+	gen, err := captureSQL(func() error { return j.run(context.Background(), span{}, span{}) })
+	csvLoc = savedLoc
+	if err != nil {
+		return err
+	}
+	if _, err := d.Exec(string(gen)); err != nil {
+		return fmt.Errorf("applying SQL: %v", err)
+	}
+	// The hourly sums, and the 5 minute sums, increase by 0.1 per reading.
+	offset := -time.Hour
+	if *attribution == attrStarting {
+		offset = 0
+	}
+	if err := checkRecords(d, longName(), base.Add(offset), time.Hour, 3, 1.2); err != nil {
+		return err
+	}
+	return checkRecords(d, shortName(), base.Add(offset/12), time.Minute*5, 25, 0.1)
+}
+
+// captureSQL returns the SQL generated by the function, and any error it returns.
+func captureSQL(f func() error) ([]byte, error) {
+	var b bytes.Buffer
+	saved := setOutput(&b)
+	err := f()
+	if ferr := sqlOut.Flush(); err == nil {
+		err = ferr
+	}
+	sqlOut = saved
+	return b.Bytes(), err
+}
+
+// createSchema creates the Home Assistant statistics tables.
+func createSchema(d *sql.DB) error {
+	stmts := []string{
+		fmt.Sprintf("CREATE TABLE %s (id INTEGER PRIMARY KEY, statistic_id VARCHAR(255), source VARCHAR(32), "+
+			"unit_of_measurement VARCHAR(255), has_mean BOOLEAN, has_sum BOOLEAN, name VARCHAR(255))", metaName()),
+	}
+	for _, t := range []string{longName(), shortName()} {
+		// Both the datetime and epoch columns are present, as in schemas since 2023.4.
+		stmts = append(stmts, fmt.Sprintf("CREATE TABLE %s (id INTEGER PRIMARY KEY, created DATETIME, "+
+			"created_ts FLOAT, metadata_id INTEGER, start DATETIME, start_ts FLOAT, mean FLOAT, min FLOAT, max FLOAT, "+
+			"last_reset DATETIME, last_reset_ts FLOAT, state FLOAT, sum FLOAT)", t))
+	}
+	for _, s := range stmts {
+		if _, err := d.Exec(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRecords verifies the number of records in the table, and that
+// consecutive records start one period apart with sums increasing by inc.
+func checkRecords(d *sql.DB, table string, first time.Time, period time.Duration, count int, inc float64) error {
+	rows, err := d.Query(fmt.Sprintf("SELECT %s, sum FROM %s WHERE metadata_id = "+
+		"(SELECT id FROM %s WHERE statistic_id = ?) ORDER BY %s", timeSQL(startCol()), table, metaName(), startCol()), selftestId)
+	if err != nil {
+		return fmt.Errorf("%s: %v", table, err)
+	}
+	defer rows.Close()
+	n := 0
+	for ; rows.Next(); n++ {
+		var start string
+		var sum float64
+		if err := rows.Scan(&start, &sum); err != nil {
+			return fmt.Errorf("%s: %v", table, err)
+		}
+		want := first.Add(period * time.Duration(n)).Format(dbTimeFmt)
+		if start != want {
+			return fmt.Errorf("%s: record %d starts at %s, expected %s", table, n, start, want)
+		}
+		if math.Abs(sum-inc*float64(n)) > 0.001 {
+			return fmt.Errorf("%s: record %d (%s) has sum %f, expected %f", table, n, start, sum, inc*float64(n))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("%s: %v", table, err)
+	}
+	if n != count {
+		return fmt.Errorf("%s: %d records, expected %d", table, n, count)
+	}
+	fmt.Printf("selftest: %s: %d records OK\n", table, n)
+	return nil
+}
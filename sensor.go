@@ -0,0 +1,85 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Generic sensors, backfilled as measurement statistics identified
+// by their statistic_id rather than a metadata_id key.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// sensorList holds the values of the repeatable -sensor flag.
+type sensorList []string
+
+func (l *sensorList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *sensorList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+var sensors sensorList
+
+func init() {
+	flag.Var(&sensors, "sensor", "Sensor column to backfill as a measurement statistic, as COLUMN=STATISTIC_ID[,UNIT] (may be repeated)")
+}
+
+// Valid statistic ids e.g sensor.outside_temperature
+var statIdRe = regexp.MustCompile(`^[a-z0-9_]+[.:][a-z0-9_]+$`)
+
+// parseSensor creates a measurement statistic from a -sensor flag value.
+func parseSensor(v string) (*stat, error) {
+	col, rest, found := strings.Cut(v, "=")
+	if !found || col == "" {
+		return nil, fmt.Errorf("%s: expected COLUMN=STATISTIC_ID[,UNIT]", v)
+	}
+	id, unit, _ := strings.Cut(rest, ",")
+	if !statIdRe.MatchString(id) {
+		return nil, fmt.Errorf("%s: invalid statistic_id", id)
+	}
+	return &stat{name: id, column: col, id: id, unit: unit, mean: true, scale: 1}, nil
+}
+
+// keySQL returns the SQL for the metadata_id of this statistic. If the key
+// is not known, it is looked up in statistics_meta using the statistic_id.
+func (s *stat) keySQL() string {
+	if s.key != 0 {
+		return fmt.Sprint(s.key)
+	}
+	return fmt.Sprintf("(SELECT %s FROM %s WHERE %s = %s)", quoteIdent("id"), quoteIdent(metaName()),
+		quoteIdent("statistic_id"), sqlQuote(s.id))
+}
+
+// metaSQL generates SQL to create the statistics_meta record for
+// a statistic that is identified only by its statistic_id.
+func (s *stat) metaSQL() {
+	meta := quoteIdent(metaName())
+	fmt.Fprintf(sqlOut, "INSERT INTO %s (%s) "+
+		"SELECT %s, 'recorder', %s, %s, %s, NULL%s "+
+		"WHERE NOT EXISTS (SELECT 1 FROM %s WHERE %s = %s);\n",
+		meta, quoteIdents("statistic_id", "source", "unit_of_measurement", "has_mean", "has_sum", "name"),
+		sqlQuote(s.id), sqlQuote(s.unit), boolSQL(s.mean), boolSQL(!s.mean), fromDual(), meta, quoteIdent("statistic_id"), sqlQuote(s.id))
+}
+
+// sqlQuote returns the string as a quoted SQL string literal.
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
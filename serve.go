@@ -0,0 +1,429 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Preview server, which serves a local web page of charts of the daily
+// totals (or means) of the statistics to be imported, along with the
+// anomalies detected, so that the import can be visually checked
+// before the SQL is applied. When a database is given, the page has a
+// button to apply the SQL directly to it. If a token is set, every POST
+// request must give it, and the page is opened with it as ?token=TOKEN.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"flag"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var serve = flag.String("serve", "", "Serve a preview of the import on this address e.g localhost:8080, with a button to apply the SQL if -db or -database is given")
+var serveToken = flag.String("serve-token", "", "Token required by the preview server's POST requests, in the X-Backfill-Token header (or as a bearer token); required unless -serve is a loopback address")
+
+// The generated SQL, when serving a preview or applying it directly.
+var servedSQL bytes.Buffer
+
+// Size of the charts, in pixels.
+const chartWidth = 900
+const chartHeight = 160
+
+// Preview of one statistic.
+type previewStat struct {
+	Job        string        `json:"job"`
+	Name       string        `json:"name"`
+	Id         string        `json:"statistic_id,omitempty"`
+	Unit       string        `json:"unit"`
+	Daily      []previewDay  `json:"daily"`
+	Chart      template.HTML `json:"-"`
+	Increments []previewRow  `json:"increments,omitempty"` // Largest hourly increments
+	Resets     []previewRow  `json:"resets,omitempty"`
+	Gaps       []previewRow  `json:"gaps,omitempty"`
+}
+
+// The daily total, or mean, of a statistic.
+type previewDay struct {
+	Date  string  `json:"date"`
+	Value float64 `json:"value"`
+}
+
+// A row of a table of increments, resets or gaps.
+type previewRow struct {
+	From   string `json:"from,omitempty"`
+	To     string `json:"to"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// The preview server's state.
+type preview struct {
+	Summary  string        `json:"summary"`
+	Stats    []previewStat `json:"statistics"`
+	SQLBytes int           `json:"sql_bytes"`
+	DB       string        `json:"database,omitempty"`
+	Applied  string        `json:"applied,omitempty"` // Result of applying the SQL
+	mu       sync.Mutex
+	long     span   // Span of the long term statistics generated
+	short    span   // Span of the short term statistics generated
+	upload   string // Directory of the uploaded files
+}
+
+var previewPage = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>ha-backfill preview</title>
+<style>body{font-family:sans-serif;margin:2em}table{border-collapse:collapse}td,th{padding:2px 8px;text-align:left}
+svg{background:#f8f8f8}rect{fill:#3b7dd8}.warn{color:#b00}</style></head>
+<body><h1>ha-backfill preview</h1>
+<p>{{.Summary}}</p>
+<p><a href="/sql{{if .Token}}?token={{.Token}}{{end}}">Download the SQL</a> ({{.SQLBytes}} bytes)</p>
+{{if .DB}}{{if .Applied}}<p class="warn">{{.Applied}}</p>{{else}}
+<form method="post" action="/apply">{{if .Token}}<input type="hidden" name="token" value="{{.Token}}">{{end}}<button type="submit">Apply to {{.DB}}</button></form>{{end}}{{end}}
+{{range .Stats}}<h2>{{.Job}}: {{.Name}}{{if .Id}} ({{.Id}}){{end}}</h2>
+{{.Chart}}
+{{if .Increments}}<h3>Largest hourly increments</h3><table><tr><th>Start</th><th>End</th><th>Increment</th><th>Source</th></tr>
+{{range .Increments}}<tr><td>{{.From}}</td><td>{{.To}}</td><td>{{.Value}}</td><td>{{.Source}}</td></tr>{{end}}</table>{{end}}
+{{if .Resets}}<h3 class="warn">Meter resets</h3><table><tr><th>Time</th><th>Sum before</th><th>Source</th></tr>
+{{range .Resets}}<tr><td>{{.To}}</td><td>{{.Value}}</td><td>{{.Source}}</td></tr>{{end}}</table>{{end}}
+{{if .Gaps}}<h3 class="warn">Gaps in the readings</h3><table><tr><th>From</th><th>To</th><th>Length</th><th>Source</th></tr>
+{{range .Gaps}}<tr><td>{{.From}}</td><td>{{.To}}</td><td>{{.Value}}</td><td>{{.Source}}</td></tr>{{end}}</table>{{end}}
+{{end}}</body></html>
+`))
+
+// runServer serves the preview of the jobs and the generated SQL until the process is stopped.
+func runServer(jobs []*job, dbName string, long, short span) {
+	p := &preview{long: long, short: short}
+	if db != nil {
+		p.DB = dbName
+	}
+	if err := p.update(jobs); err != nil {
+		fatalf("preview: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", p.page)
+	mux.HandleFunc("/sql", p.sql)
+	mux.HandleFunc("/apply", p.apply)
+	b := newBackfill(p)
+	p.handleAPI(mux, b)
+	if *rpcAddr != "" {
+		go runRPC(b)
+	}
+	log.Printf("serving the preview on http://%s/", *serve)
+	log.Fatal(http.ListenAndServe(*serve, requireToken(mux)))
+}
+
+// checkServe verifies that the preview server, and its JSON-RPC interface,
+// are only reachable from other hosts if the token is set. The JSON-RPC
+// interface cannot carry the token, so it must always be a loopback address.
+func checkServe() error {
+	if *serve != "" && *serveToken == "" && !isLoopback(*serve) {
+		return fmt.Errorf("-serve %s: -serve-token is required unless serving on a loopback address", *serve)
+	}
+	if *rpcAddr != "" && !isLoopback(*rpcAddr) {
+		return fmt.Errorf("-rpc %s: must be a loopback address", *rpcAddr)
+	}
+	return nil
+}
+
+// isLoopback returns true if the address is only reachable from this host.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requireToken refuses POST requests, and requests for the generated SQL
+// (which may contain the token), without the token, if one is set.
+func requireToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		guarded := r.Method == http.MethodPost || r.URL.Path == "/sql" || r.URL.Path == "/api/sql"
+		if guarded && !validToken(requestToken(r)) {
+			http.Error(w, "token required", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestToken returns the token given by the request, from the
+// X-Backfill-Token header, a bearer token, the form of the preview page,
+// or the query of the preview page's link to the SQL.
+func requestToken(r *http.Request) string {
+	if t := r.Header.Get("X-Backfill-Token"); t != "" {
+		return t
+	}
+	if a := r.Header.Get("Authorization"); strings.HasPrefix(a, "Bearer ") {
+		return strings.TrimPrefix(a, "Bearer ")
+	}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/x-www-form-urlencoded" {
+		return r.PostFormValue("token")
+	}
+	if r.Method == http.MethodGet {
+		return r.URL.Query().Get("token")
+	}
+	return ""
+}
+
+// validToken returns true if the token matches the one set, or none is set.
+func validToken(t string) bool {
+	return *serveToken == "" || subtle.ConstantTimeCompare([]byte(t), []byte(*serveToken)) == 1
+}
+
+// update updates the preview of the jobs and the SQL generated for them.
+func (p *preview) update(jobs []*job) error {
+	p.Summary, p.SQLBytes, p.Stats, p.Applied = runSummary(jobs), servedSQL.Len(), nil, ""
+	for _, j := range jobs {
+		stats, err := j.derived()
+		if err != nil {
+			return err
+		}
+		for _, s := range stats {
+			ps := previewStat{Job: j.name, Name: s.name, Id: s.id, Unit: s.unit}
+			days, values := s.daily()
+			for i := range days {
+				ps.Daily = append(ps.Daily, previewDay{Date: days[i].Format("2006-01-02"), Value: values[i]})
+			}
+			ps.Chart = s.chart(days, values)
+			for _, e := range s.events(true, span{}) {
+				ps.Resets = append(ps.Resets, previewRow{To: e.to.In(csvLoc).Format(tFmt),
+					Value: humanQuantity(float64(e.sum), s.unit), Source: e.src.String()})
+			}
+			for _, e := range s.events(false, span{}) {
+				ps.Gaps = append(ps.Gaps, previewRow{From: e.from.In(csvLoc).Format(tFmt), To: e.to.In(csvLoc).Format(tFmt),
+					Value: humanDuration(e.to.Sub(e.from)), Source: e.src.String()})
+			}
+			if !s.mean {
+				for _, inc := range s.largestIncrements() {
+					ps.Increments = append(ps.Increments, previewRow{From: inc.start, To: inc.end,
+						Value: humanQuantity(float64(inc.value), s.unit), Source: inc.src.String()})
+				}
+			}
+			p.Stats = append(p.Stats, ps)
+		}
+	}
+	return nil
+}
+
+// page serves the preview page.
+func (p *preview) page(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	// The token is only added to the page's form if the page was opened with it.
+	var token string
+	if t := r.URL.Query().Get("token"); *serveToken != "" && validToken(t) {
+		token = t
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := previewPage.Execute(w, struct {
+		*preview
+		Token string
+	}{p, token}); err != nil {
+		log.Printf("preview: %v", err)
+	}
+}
+
+// sql serves the generated SQL.
+func (p *preview) sql(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w.Header().Set("Content-Type", "application/sql")
+	w.Header().Set("Content-Disposition", `attachment; filename="backfill.sql"`)
+	w.Write(servedSQL.Bytes())
+}
+
+// apply applies the SQL to the database from the preview page.
+func (p *preview) apply(w http.ResponseWriter, r *http.Request) {
+	if !applyAllowed(w, r) {
+		return
+	}
+	p.applyOnce(context.Background(), log.Default())
+	to := "/"
+	if *serveToken != "" {
+		to += "?token=" + url.QueryEscape(requestToken(r))
+	}
+	http.Redirect(w, r, to, http.StatusSeeOther)
+}
+
+// applyAllowed returns true if the request may apply the SQL, otherwise
+// the request is refused.
+func applyAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost || db == nil {
+		http.Error(w, "not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return sameOrigin(w, r)
+}
+
+// sameOrigin returns true if the request may change the preview or its
+// tasks, otherwise the request is refused. Only requests from the preview
+// page itself, or from outside a browser, are accepted.
+func sameOrigin(w http.ResponseWriter, r *http.Request) bool {
+	if o := r.Header.Get("Origin"); o != "" && strings.TrimPrefix(strings.TrimPrefix(o, "http://"), "https://") != r.Host {
+		http.Error(w, "cross origin request refused", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// applyOnce applies the SQL to the database, unless it has already been
+// applied, returning false if applying it failed, with the result logged
+// to the logger. If the context is cancelled while the SQL is being
+// applied, it is rolled back.
+func (p *preview) applyOnce(ctx context.Context, logger *log.Logger) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Applied != "" {
+		return !strings.HasPrefix(p.Applied, applyFailed) && !strings.HasPrefix(p.Applied, applyPostCommit)
+	}
+	start := time.Now()
+	n, committed, err := applyJournaled(ctx, db, servedSQL.Bytes())
+	if err != nil && committed {
+		p.Applied = fmt.Sprintf("%s after %d statements: %v", applyPostCommit, n, err)
+	} else if err != nil {
+		p.Applied = fmt.Sprintf("%s after %d statements: %v", applyFailed, n, err)
+	} else {
+		p.Applied = fmt.Sprintf("Applied %s statements to %s in %s", thousands(n), p.DB, humanDuration(time.Since(start)))
+	}
+	logger.Printf("preview: %s", p.Applied)
+	return err == nil
+}
+
+// Start of the result of applying the SQL if it failed, and was rolled
+// back, or if a statement after its COMMIT (e.g ANALYZE) failed.
+const applyFailed = "Applying the SQL failed"
+const applyPostCommit = "Applied, but a post-commit step failed"
+
+// applySQL executes the statements of the SQL one at a time, on a single
+// connection so that the transaction of the SQL is respected, returning
+// the number of statements executed, and true if its COMMIT was executed.
+// If a statement fails, the transaction is rolled back.
+func applySQL(ctx context.Context, d *sql.DB, script []byte) (int, bool, error) {
+	conn, err := d.Conn(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer conn.Close()
+	n := 0
+	committed := false
+	var stmt strings.Builder
+	sc := bufio.NewScanner(bytes.NewReader(script))
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if stmt.Len() == 0 && (line == "" || strings.HasPrefix(line, "--")) {
+			continue
+		}
+		stmt.WriteString(line)
+		stmt.WriteByte('\n')
+		if !strings.HasSuffix(line, ";") {
+			continue
+		}
+		if _, err := conn.ExecContext(ctx, stmt.String()); err != nil {
+			conn.ExecContext(context.Background(), "ROLLBACK")
+			return n, committed, err
+		}
+		if stmt.String() == "COMMIT;\n" {
+			committed = true
+		}
+		n++
+		stmt.Reset()
+	}
+	return n, committed, sc.Err()
+}
+
+// daily returns the daily totals of the statistic, or the daily means of a measurement.
+func (s *stat) daily() ([]time.Time, []float64) {
+	var days []time.Time
+	var values []float64
+	var counts []int
+	var prev *record
+	for _, r := range s.records(time.Hour, span{skip: s.skip}) {
+		day, _ := dayStart(r.start)
+		n := len(days)
+		if n == 0 || !days[n-1].Equal(day) {
+			days = append(days, day)
+			values = append(values, 0)
+			counts = append(counts, 0)
+			n++
+		}
+		if r.mean {
+			values[n-1] += float64(r.avg)
+		} else if prev != nil {
+			values[n-1] += float64(r.sum - prev.sum)
+		}
+		counts[n-1]++
+		r := r
+		prev = &r
+	}
+	if s.mean {
+		for i := range values {
+			values[i] /= float64(counts[i])
+		}
+	}
+	return days, values
+}
+
+// chart returns an SVG bar chart of the daily values of the statistic.
+func (s *stat) chart(days []time.Time, values []float64) template.HTML {
+	if len(days) == 0 {
+		return "<p>No records</p>"
+	}
+	var min, max float64
+	for i := range values {
+		if values[i] < min {
+			min = values[i]
+		}
+		if values[i] > max {
+			max = values[i]
+		}
+	}
+	if max == min {
+		max = min + 1
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg width="%d" height="%d" viewBox="0 0 %d %d">`, chartWidth, chartHeight+20, chartWidth, chartHeight+20)
+	bw := float64(chartWidth) / float64(len(days))
+	zero := float64(chartHeight) * max / (max - min)
+	for i, v := range values {
+		y, h := zero-float64(chartHeight)*v/(max-min), float64(chartHeight)*v/(max-min)
+		if h < 0 {
+			y, h = zero, -h
+		}
+		fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f"><title>%s: %s</title></rect>`,
+			float64(i)*bw, y, bw*0.9, h, days[i].Format("2006-01-02"), html.EscapeString(humanQuantity(v, s.unit)))
+	}
+	fmt.Fprintf(&b, `<text x="2" y="%d" font-size="12">%s</text>`, chartHeight+16, days[0].Format("2006-01-02"))
+	fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="12" text-anchor="end">%s</text>`, chartWidth-2, chartHeight+16, days[len(days)-1].Format("2006-01-02"))
+	fmt.Fprintf(&b, `<text x="2" y="12" font-size="12">max %s</text></svg>`, html.EscapeString(humanQuantity(max, s.unit)))
+	return template.HTML(b.String())
+}
@@ -0,0 +1,184 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The snapshot and restore commands. snapshot saves the rows of the
+// statistics, short term statistics and metadata tables (either all of
+// them, or those of selected metadata_ids) to a file, and restore
+// generates the SQL that replaces the rows with those of the snapshot,
+// as a safety net before experimenting with backfills.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var snapshotKeys = flag.String("snapshot-keys", "", "Comma separated metadata_ids saved by the snapshot command (default is all)")
+
+// Snapshot file contents.
+type snapshotFile struct {
+	Version  string                   `json:"version"`
+	Created  string                   `json:"created"`
+	Database string                   `json:"database"`
+	Keys     []int                    `json:"keys,omitempty"` // Keys saved, or all if none
+	Tables   map[string]snapshotTable `json:"tables"`         // Rows of the meta, long and short term tables
+}
+
+// Rows of one table, with the values formatted as SQL literals.
+type snapshotTable struct {
+	Name    string     `json:"name"`
+	Columns []string   `json:"columns"`
+	Rows    [][]string `json:"rows"`
+}
+
+// Values of a snapshot, which are checked before being included in the SQL.
+var literalRe = regexp.MustCompile(`^(NULL|TRUE|FALSE|[-+0-9.eE]+|'([^']|'')*')$`)
+
+// Tables in a snapshot, in the order they are restored.
+var snapshotRoles = []string{"meta", "long", "short"}
+
+// snapshotColumns returns the table and the columns saved for the role.
+// The ids of the statistics records are not saved, as they are not
+// referred to, so the restored records are given new ids.
+func snapshotColumns(role string) (string, []string) {
+	if role == "meta" {
+		return metaName(), []string{"id", "statistic_id", "source", "unit_of_measurement", "has_mean", "has_sum", "name"}
+	}
+	cols := recordColumns()
+	if role == "long" {
+		return longName(), cols
+	}
+	return shortName(), cols
+}
+
+// snapshot saves the rows of the statistics tables to the file.
+func snapshot(file, dbName string) error {
+	snap := snapshotFile{Version: version, Created: time.Now().Format(time.RFC3339), Database: dbName,
+		Tables: make(map[string]snapshotTable)}
+	var keys []string
+	if *snapshotKeys != "" {
+		for _, k := range strings.Split(*snapshotKeys, ",") {
+			key, err := strconv.Atoi(strings.TrimSpace(k))
+			if err != nil {
+				return fmt.Errorf("-snapshot-keys %s: invalid metadata_id", k)
+			}
+			snap.Keys = append(snap.Keys, key)
+			keys = append(keys, strconv.Itoa(key))
+		}
+	}
+	for _, role := range snapshotRoles {
+		table, cols := snapshotColumns(role)
+		var where string
+		if len(keys) != 0 {
+			col := "metadata_id"
+			if role == "meta" {
+				col = "id"
+			}
+			where = fmt.Sprintf("WHERE %s IN (%s)", col, strings.Join(keys, ", "))
+		}
+		rows, err := tableRows(db, table, cols, where)
+		if err != nil {
+			return fmt.Errorf("%s: %v", table, err)
+		}
+		snap.Tables[role] = snapshotTable{Name: table, Columns: cols, Rows: rows}
+		log.Printf("%s: %s rows saved", table, thousands(len(rows)))
+	}
+	data, err := json.Marshal(&snap)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0600)
+}
+
+// restore generates the SQL that replaces the rows of the statistics
+// tables with those of the snapshot. If the snapshot is of selected
+// metadata_ids, only the rows of those are replaced.
+func restore(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var snap snapshotFile
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	// The snapshot is checked before any SQL is generated.
+	for _, role := range snapshotRoles {
+		t, ok := snap.Tables[role]
+		if !ok {
+			return fmt.Errorf("no %s table in the snapshot", role)
+		}
+		if _, cols := snapshotColumns(role); strings.Join(t.Columns, ",") != strings.Join(cols, ",") {
+			return fmt.Errorf("%s: columns in the snapshot do not match -schema=%s", t.Name, *schema)
+		}
+		for _, r := range t.Rows {
+			if len(r) != len(t.Columns) {
+				return fmt.Errorf("%s: invalid row in the snapshot", t.Name)
+			}
+			for _, v := range r {
+				if !literalRe.MatchString(v) {
+					return fmt.Errorf("%s: invalid value in the snapshot: %s", t.Name, v)
+				}
+			}
+		}
+	}
+	var keys []string
+	for _, k := range snap.Keys {
+		keys = append(keys, strconv.Itoa(k))
+	}
+	fmt.Fprintf(sqlOut, "-- Restore of the snapshot of %s taken at %s\n", snap.Database, snap.Created)
+	sessionSQL()
+	if *transaction {
+		fmt.Fprintln(sqlOut, "BEGIN;")
+	}
+	// The statistics are removed before their metadata, and the metadata restored first.
+	for i := len(snapshotRoles) - 1; i >= 0; i-- {
+		role := snapshotRoles[i]
+		table, _ := snapshotColumns(role)
+		var where string
+		if len(keys) != 0 {
+			col := "metadata_id"
+			if role == "meta" {
+				col = "id"
+			}
+			where = fmt.Sprintf(" WHERE %s IN (%s)", quoteIdent(col), strings.Join(keys, ", "))
+		}
+		fmt.Fprintf(sqlOut, "DELETE FROM %s%s;\n", quoteIdent(table), where)
+	}
+	for _, role := range snapshotRoles {
+		t := snap.Tables[role]
+		table, _ := snapshotColumns(role)
+		for _, r := range t.Rows {
+			fmt.Fprintf(sqlOut, "INSERT INTO %s (%s) VALUES (%s);\n", quoteIdent(table), quoteIdents(t.Columns...), strings.Join(r, ", "))
+		}
+		// PostgreSQL's sequence is not advanced past ids that are inserted explicitly.
+		if role == "meta" && dialect == dialectPostgres {
+			fmt.Fprintf(sqlOut, "SELECT setval(pg_get_serial_sequence(%s, 'id'), (SELECT MAX(%s) FROM %s));\n",
+				sqlQuote(quoteIdent(table)), quoteIdent("id"), quoteIdent(table))
+		}
+		log.Printf("%s: %s rows restored", table, thousands(len(t.Rows)))
+	}
+	if *transaction {
+		fmt.Fprintln(sqlOut, "COMMIT;")
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Generation of the statistics records and the SQL to insert them.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Writer of the generated SQL, which is buffered as there
+// may be millions of lines.
+var sqlOut = bufio.NewWriterSize(os.Stdout, 64*1024)
+
+// setOutput directs the generated SQL to the writer, returning the previous
+// SQL writer. Any SQL already generated should be flushed first.
+func setOutput(w io.Writer) *bufio.Writer {
+	prev := sqlOut
+	sqlOut = bufio.NewWriterSize(w, 64*1024)
+	return prev
+}
+
+// One record in a statistics table.
+type record struct {
+	created time.Time // Time record was created (UTC)
+	start   time.Time // Start of period (UTC)
+	mean    bool      // Measurement record, with mean/min/max rather than state/sum
+	state   float32   // Sample value at end of period
+	sum     float32   // Running sum at end of period
+	avg     float32   // Mean value over the period
+	min     float32   // Minimum value over the period
+	max     float32   // Maximum value over the period
+	reset   time.Time // Time the running sum was last reset
+}
+
+// Number of records generated.
+var recordCount int
+
+// A time span, either end of which may be open (zero).
+type span struct {
+	from, to time.Time
+	partial  bool   // Only the existing records within the span are replaced
+	skip     []span // Periods within the span that are left unchanged
+}
+
+// contains returns true if the time is within the span.
+func (sp span) contains(t time.Time) bool {
+	for _, sk := range sp.skip {
+		if sk.contains(t) {
+			return false
+		}
+	}
+	return (sp.from.IsZero() || !t.Before(sp.from)) && (sp.to.IsZero() || t.Before(sp.to))
+}
+
+// where returns the SQL conditions selecting records that start within
+// the span and outside its skipped periods, or no conditions if all the
+// records are replaced.
+func (sp span) where() string {
+	var w string
+	start := quoteIdent(startCol())
+	if sp.partial && !sp.from.IsZero() {
+		w += fmt.Sprintf(" AND %s >= %s", start, timeValue(sp.from))
+	}
+	if sp.partial && !sp.to.IsZero() {
+		w += fmt.Sprintf(" AND %s < %s", start, timeValue(sp.to))
+	}
+	for _, sk := range sp.skip {
+		w += fmt.Sprintf(" AND NOT (%s >= %s AND %s < %s)", start, timeValue(sk.from), start, timeValue(sk.to))
+	}
+	return w
+}
+
+// records returns the records for periods of the given length,
+// for the periods starting within the span.
+func (s *stat) records(period time.Duration, sp span) []record {
+	if s.mean {
+		return s.meanRecords(period, sp)
+	}
+	var recs []record
+	adjust, before := s.boundaryAdjust()
+	values := s.resampled(period)
+	var last sample // The last sample on a period boundary
+	var found bool
+	for _, v := range values {
+		if !v.t.After(before) {
+			continue
+		}
+		utc := v.t.In(time.UTC)
+		// Only samples on a period boundary are used.
+		if utc.Truncate(period) != utc {
+			continue
+		}
+		prev, prevFound := last, found
+		last, found = v, true
+		// Start date/time is 1 period before the sample time, unless
+		// the samples are attributed to the period starting at their time.
+		start := periodStart(utc, period)
+		if !sp.contains(start) {
+			continue
+		}
+		sum := v.sum
+		if f := cutFraction(start, period, sp); f != 1 && prevFound {
+			sum = prev.sum + (sum-prev.sum)*f
+		}
+		// Create time is offset by 10 seconds after the end of the period
+		// (to match what home assistant recorder does)
+		recs = append(recs, record{created: start.Add(period + time.Second*10), start: start,
+			state: v.value, sum: sum + adjust, reset: v.reset})
+	}
+	// The partial period after the last sample on a period boundary.
+	if n := len(values); found && n != 0 {
+		end := values[n-1]
+		start := periodStart(last.t.In(time.UTC).Add(period), period)
+		if sum, ok := finalPeriod(last, end, period); ok && sp.contains(start) {
+			recs = append(recs, record{created: start.Add(period + time.Second*10), start: start,
+				state: end.value, sum: sum + adjust, reset: end.reset})
+		}
+	}
+	return recs
+}
+
+// periodStart returns the start of the period of the sample on a period
+// boundary at utc.
+func periodStart(utc time.Time, period time.Duration) time.Time {
+	if *attribution == attrStarting {
+		return utc
+	}
+	return utc.Add(-period)
+}
+
+// meanRecords returns the mean, minimum and maximum of the samples
+// within each period. Samples are attributed to the period ending at
+// or after the sample time, or with starting attribution, to the period
+// starting at or before the sample time.
+func (s *stat) meanRecords(period time.Duration, sp span) []record {
+	var recs []record
+	var total float32
+	var count int
+	for _, v := range s.values {
+		end := v.t.In(time.UTC).Truncate(period)
+		if *attribution == attrStarting || !end.Equal(v.t) {
+			end = end.Add(period)
+		}
+		start := end.Add(-period)
+		if !sp.contains(start) {
+			continue
+		}
+		n := len(recs)
+		if n == 0 || !recs[n-1].start.Equal(start) {
+			recs = append(recs, record{created: end.Add(time.Second * 10), start: start, mean: true,
+				min: v.value, max: v.value})
+			total = 0
+			count = 0
+			n++
+		}
+		r := &recs[n-1]
+		if v.value < r.min {
+			r.min = v.value
+		}
+		if v.value > r.max {
+			r.max = v.value
+		}
+		total += v.value
+		count++
+		r.avg = total / float32(count)
+	}
+	return recs
+}
+
+// generateSQL generates SQL commands to remove old statistic records
+// and to insert new records.
+// In merge mode the old records are retained, and new records are only
+// inserted where no record exists for that time. If the database is available,
+// records that already exist with identical values are not generated at all.
+// Long and short term records are generated for periods starting within
+// their spans, and only the records within the spans are removed.
+func (s *stat) generateSQL(long, short span) error {
+	var lt, st map[string]string
+	key := s.keySQL()
+	if s.key == 0 {
+		s.metaSQL()
+	}
+	long, short = boundarySpan(long, time.Hour), boundarySpan(short, time.Minute*5)
+	lrecs := s.records(time.Hour, long)
+	srecs := s.records(time.Minute*5, short)
+	if err := s.rollbackSQL(longName(), long); err != nil {
+		return err
+	}
+	if err := s.rollbackSQL(shortName(), short); err != nil {
+		return err
+	}
+	if s.key == 0 {
+		s.rollbackMetaSQL()
+	}
+	s.written = append(s.written, tableCount{longName(), long.where(), len(lrecs)}, tableCount{shortName(), short.where(), len(srecs)})
+	if !*merge {
+		deleteSQL(longName(), key, long, lrecs)
+		deleteSQL(shortName(), key, short, srecs)
+	} else if db != nil && s.key != 0 {
+		var err error
+		if lt, err = existingRecords(db, longName(), s.key); err != nil {
+			return fmt.Errorf("%s: %v", longName(), err)
+		}
+		if st, err = existingRecords(db, shortName(), s.key); err != nil {
+			return fmt.Errorf("%s: %v", shortName(), err)
+		}
+	}
+	for _, r := range lrecs {
+		r.insert(longName(), key, lt)
+	}
+	for _, r := range srecs {
+		r.insert(shortName(), key, st)
+	}
+	return nil
+}
+
+// values returns the formatted mean, min, max, state and sum of the record,
+// in the same form as existingRecords.
+func (r *record) values() string {
+	if r.mean {
+		return fmt.Sprintf("%f, %f, %f, NULL, NULL", r.avg, r.min, r.max)
+	}
+	return fmt.Sprintf("NULL, NULL, NULL, %f, %f", r.state, r.sum)
+}
+
+// insert generates the SQL to insert a record into the selected table.
+// No record is generated if an identical one is in the existing set.
+func (r *record) insert(table string, key string, existing map[string]string) {
+	const tf = "2006-01-02 15:04:05"
+	start := r.start.Format(tf)
+	if rec, ok := existing[start]; ok && rec == r.values() {
+		return
+	}
+	var cols []string
+	var vals string
+	if r.mean {
+		cols = []string{createdCol(), startCol(), "mean", "min", "max", "metadata_id"}
+		vals = fmt.Sprintf("%s, %s, %f, %f, %f, %s", timeValue(r.created), timeValue(r.start), r.avg, r.min, r.max, key)
+	} else {
+		cols = []string{createdCol(), startCol(), "state", "sum", "metadata_id"}
+		vals = fmt.Sprintf("%s, %s, %f, %f, %s", timeValue(r.created), timeValue(r.start), r.state, r.sum, key)
+		// Older schemas expect last_reset to be set for metered values.
+		if *schema == schemaLegacy {
+			cols = append(cols, lastResetCol())
+			vals += ", " + timeValue(r.reset)
+		}
+	}
+	table = quoteIdent(insertTable(table))
+	if *merge {
+		recordCount++
+		fmt.Fprintf(sqlOut, "INSERT INTO %s (%s) SELECT %s%s "+
+			"WHERE NOT EXISTS (SELECT 1 FROM %s WHERE %s = %s AND %s = %s);\n",
+			table, quoteIdents(cols...), vals, fromDual(), table, quoteIdent("metadata_id"), key, quoteIdent(startCol()), timeValue(r.start))
+		return
+	}
+	recordCount++
+	fmt.Fprintf(sqlOut, "INSERT INTO %s (%s) VALUES (%s);\n", table, quoteIdents(cols...), vals)
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// SSH tunnelling to a database that is only reachable from the
+// Home Assistant host. The system ssh client is used so that the
+// user's keys, agent and known hosts apply as usual.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+var sshHost = flag.String("ssh", "", "Connect to the database through an SSH tunnel to user@host")
+
+// How long to wait for the tunnel to be established.
+const sshTimeout = time.Second * 15
+
+// tunnel starts an SSH tunnel forwarding a local port to the address
+// as seen from the SSH host, and returns the local address.
+// The remote side runs cat on the tunnel's stdin, so the tunnel
+// is closed when this process exits.
+func tunnel(addr string) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	local := l.Addr().String()
+	l.Close()
+	cmd := exec.Command("ssh", "-T", "-o", "ExitOnForwardFailure=yes", "-L", local+":"+addr, *sshHost, "cat")
+	cmd.Stderr = os.Stderr
+	if _, err := cmd.StdinPipe(); err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	for end := time.Now().Add(sshTimeout); time.Now().Before(end); {
+		select {
+		case err := <-exited:
+			return "", fmt.Errorf("%s: ssh exited: %v", *sshHost, err)
+		case <-time.After(time.Millisecond * 200):
+		}
+		if c, err := net.Dial("tcp", local); err == nil {
+			c.Close()
+			return local, nil
+		}
+	}
+	cmd.Process.Kill()
+	return "", fmt.Errorf("%s: timed out waiting for the tunnel", *sshHost)
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Staging of the new records. The records are first inserted into temporary
+// staging tables and validated, and only then are the existing records
+// removed and the staged records moved into the statistics tables, so that
+// the statistics tables are not touched unless the whole load succeeds.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var staging = flag.Bool("staging", false, "Load the records into staging tables and validate them before replacing the existing records")
+
+// The existing records are removed after the records are staged.
+var stagedDeletes bytes.Buffer
+
+// deleteOut returns the writer of the SQL that removes the existing records.
+func deleteOut() io.Writer {
+	if *staging {
+		return &stagedDeletes
+	}
+	return sqlOut
+}
+
+// insertTable returns the table that the records of the statistics table are inserted into.
+func insertTable(table string) string {
+	if *staging {
+		return stagingName(table)
+	}
+	return table
+}
+
+// stagingName returns the name of the staging table of the statistics table.
+func stagingName(table string) string {
+	return "backfill_staging_" + strings.TrimPrefix(table, *tablePrefix)
+}
+
+// stagingColumns returns the columns of the statistics tables that are staged.
+func stagingColumns() string {
+	return quoteIdents(recordColumns()...)
+}
+
+// stagingSQL generates the SQL to create the empty staging tables.
+func stagingSQL() {
+	if !*staging {
+		return
+	}
+	for _, t := range []string{longName(), shortName()} {
+		fmt.Fprintf(sqlOut, "CREATE %s %s AS SELECT %s FROM %s WHERE 1 = 0;\n",
+			tempTable(), quoteIdent(stagingName(t)), stagingColumns(), quoteIdent(t))
+	}
+}
+
+// stagingMoveSQL generates the SQL to validate the staged records, which fails
+// (via the CHECK constraints of a temporary table) if any record has an unknown
+// statistic or duplicates another record. The existing records are then removed,
+// and the staged records moved into the statistics tables.
+func stagingMoveSQL() {
+	if !*staging {
+		return
+	}
+	check := quoteIdent("backfill_staging_check")
+	known, unique := quoteIdent("known_statistics"), quoteIdent("unique_records")
+	fmt.Fprintf(sqlOut, "CREATE %s %s (%s INTEGER CHECK (%s = 1), %s INTEGER CHECK (%s = 1));\n",
+		tempTable(), check, known, known, unique, unique)
+	id, start := quoteIdent("metadata_id"), quoteIdent(startCol())
+	for _, t := range []string{longName(), shortName()} {
+		st := quoteIdent(stagingName(t))
+		fmt.Fprintf(sqlOut, "INSERT INTO %s (%s) SELECT CASE WHEN EXISTS (SELECT 1 FROM %s WHERE %s IS NULL) THEN 0 ELSE 1 END%s;\n",
+			check, known, st, id, fromDual())
+		fmt.Fprintf(sqlOut, "INSERT INTO %s (%s) SELECT CASE WHEN EXISTS (SELECT 1 FROM %s GROUP BY %s, %s HAVING COUNT(*) > 1) THEN 0 ELSE 1 END%s;\n",
+			check, unique, st, id, start, fromDual())
+	}
+	fmt.Fprintf(sqlOut, "DROP %s %s;\n", dropTemp(), check)
+	sqlOut.Write(stagedDeletes.Bytes())
+	stagedDeletes.Reset()
+	for _, t := range []string{longName(), shortName()} {
+		st := quoteIdent(stagingName(t))
+		fmt.Fprintf(sqlOut, "INSERT INTO %s (%s) SELECT %s FROM %s;\n", quoteIdent(t), stagingColumns(), stagingColumns(), st)
+		fmt.Fprintf(sqlOut, "DROP %s %s;\n", dropTemp(), st)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The staged records only replace the existing records if they are valid.
+func TestStaging(t *testing.T) {
+	saved := *staging
+	defer func() { *staging = saved }()
+	*staging = true
+	existing := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	staged := existing.Add(time.Hour)
+	tests := []struct {
+		name  string
+		keys  []string // metadata_id of each staged record, all starting at the same time
+		ok    bool
+		start time.Time // Start of the record once applied
+	}{
+		{"valid", []string{"1"}, true, staged},
+		{"duplicate", []string{"1", "1"}, false, existing},
+		{"unknown statistic", []string{"NULL"}, false, existing},
+	}
+	for i, tc := range tests {
+		d, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), fmt.Sprintf("test%d.db", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		if err := createSchema(d); err != nil {
+			t.Fatal(err)
+		}
+		insert := func(table, key string, start time.Time) string {
+			return fmt.Sprintf("INSERT INTO %s (%s, %s, %s, %s) VALUES (%s, %s, 1, %s);\n", quoteIdent(table),
+				quoteIdent(createdCol()), quoteIdent(startCol()), quoteIdent("sum"), quoteIdent("metadata_id"),
+				timeValue(start.Add(time.Hour)), timeValue(start), key)
+		}
+		if _, err := d.Exec(insert(longName(), "1", existing)); err != nil {
+			t.Fatal(err)
+		}
+		script, err := captureSQL(func() error {
+			fmt.Fprintln(sqlOut, "BEGIN;")
+			stagingSQL()
+			for _, k := range tc.keys {
+				fmt.Fprint(sqlOut, insert(insertTable(longName()), k, staged))
+			}
+			deleteSQL(longName(), "1", span{}, nil)
+			stagingMoveSQL()
+			fmt.Fprintln(sqlOut, "COMMIT;")
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := applySQL(context.Background(), d, script); (err == nil) != tc.ok {
+			t.Errorf("%s: error %v, expected success %v", tc.name, err, tc.ok)
+		}
+		var n int
+		q := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s = %s", quoteIdent(longName()), quoteIdent(startCol()), timeValue(tc.start))
+		if err := d.QueryRow(q).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		var total int
+		if err := d.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", quoteIdent(longName()))).Scan(&total); err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 || total != 1 {
+			t.Errorf("%s: %d records, %d starting at %s, expected only that one", tc.name, total, n, tc.start.Format(tFmt))
+		}
+	}
+}
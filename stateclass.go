@@ -0,0 +1,76 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// State class of the accumulating statistics, matching the state_class of
+// the Home Assistant sensor. A total_increasing counter only increases,
+// so a decrease is a reset of the counter, whereas a total (e.g a net meter or
+// a battery's energy) may decrease, and the decrease is subtracted from the sum.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var stateClasses sensorList
+
+func init() {
+	flag.Var(&stateClasses, "state-class", "State class of a statistic, as NAME=CLASS where CLASS is total_increasing (the default) or total (may be repeated)")
+}
+
+// State classes
+const classTotalIncreasing = "total_increasing" // A counter that only increases, apart from resets
+const classTotal = "total"                      // A total that may increase or decrease
+
+// setStateClass applies the -state-class flags to the statistics.
+func setStateClass(stats []*stat) error {
+	for _, c := range stateClasses {
+		name, class, _ := strings.Cut(c, "=")
+		found := false
+		for _, s := range stats {
+			if s.name == name {
+				if err := s.setClass(class); err != nil {
+					return fmt.Errorf("%s: %v", c, err)
+				}
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: unknown statistic", c)
+		}
+	}
+	return nil
+}
+
+// setClass sets the state class of the statistic.
+func (s *stat) setClass(class string) error {
+	switch class {
+	case classTotalIncreasing:
+		s.signed = false
+	case classTotal:
+		if s.mean {
+			return fmt.Errorf("a measurement has no state class of total")
+		}
+		// Smoothing assumes that the counter only increases.
+		if s.smooth != 0 {
+			return fmt.Errorf("a total cannot be smoothed")
+		}
+		s.signed = true
+	default:
+		return fmt.Errorf("%s: unknown state class", class)
+	}
+	return nil
+}
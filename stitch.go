@@ -0,0 +1,94 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Stitching of the backfilled history to the statistics that Home Assistant
+// has already recorded. The backfill is restricted to the periods before
+// the oldest existing record, and either the existing sums are offset
+// to continue on from the backfill, or the backfill is offset so that
+// it ends at the existing sums, so that the whole timeline is continuous.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+var stitch = flag.String("stitch", "", "Join the backfill to newer existing statistics: existing (offset the existing sums) or backfill (offset the backfilled sums) (requires -db or -database)")
+
+// Stitch modes
+const stitchExisting = "existing" // The existing records' sums are offset to continue from the backfill
+const stitchBackfill = "backfill" // The backfilled sums are offset to end at the existing sums
+
+// stitchTo restricts the spans to the periods before the oldest existing
+// long term record of the statistic, and joins the sums at that record.
+// The SQL to offset the existing records is generated by the returned function,
+// which is called after the backfilled records are generated.
+func (s *stat) stitchTo(long, short span) (span, span, func(), error) {
+	none := func() {}
+	if s.key == 0 {
+		return long, short, none, nil
+	}
+	start, sum, ok, err := oldestRecord(db, s.key)
+	if err != nil {
+		return long, short, none, fmt.Errorf("%s: %v", s.name, err)
+	}
+	if !ok {
+		return long, short, none, nil
+	}
+	for _, sp := range []*span{&long, &short} {
+		if sp.to.IsZero() || sp.to.After(start) {
+			sp.to = start
+		}
+		sp.partial = true
+	}
+	// Measurements and billing cycle sums are not continuous, so are not joined.
+	if s.mean || s.cycle {
+		return long, short, none, nil
+	}
+	// The backfilled sum at the end of the oldest existing record's period,
+	// or if the backfill does not reach it, at the end of the backfill.
+	var joined *record
+	recs := s.records(time.Hour, span{})
+	for i := range recs {
+		if recs[i].start.After(start) {
+			break
+		}
+		joined = &recs[i]
+	}
+	if joined == nil {
+		s.logger().Printf("%s: no backfill before the existing statistics at %s, not stitched", s.name, start.In(csvLoc).Format(tFmt))
+		return long, short, none, nil
+	}
+	if !joined.start.Equal(start) {
+		s.logger().Printf("%s: backfill ends at %s, before the existing statistics at %s",
+			s.name, joined.start.Add(time.Hour).In(csvLoc).Format(tFmt), start.In(csvLoc).Format(tFmt))
+	}
+	offset := float64(joined.sum) - sum
+	if *stitch == stitchBackfill {
+		for i := range s.values {
+			s.values[i].sum -= float32(offset)
+		}
+		return long, short, none, nil
+	}
+	return long, short, func() {
+		for _, t := range []string{longName(), shortName()} {
+			sum := quoteIdent("sum")
+			fmt.Fprintf(sqlOut, "UPDATE %s SET %s = %s + %f WHERE %s = %s AND %s >= %s;\n",
+				quoteIdent(t), sum, sum, offset, quoteIdent("metadata_id"), s.keySQL(), quoteIdent(startCol()), timeValue(start))
+			s.rollbackOffset(t, offset, start)
+		}
+	}, nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The backfill is joined to the existing records, and the rollback
+// removes the backfill and any offset added to the existing sums.
+func TestStitchRollback(t *testing.T) {
+	dir := t.TempDir()
+	csvDir := filepath.Join(dir, "csv")
+	if err := os.Mkdir(csvDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Readings from 00:00 to 02:00, using 1.2 kWh each hour.
+	var b strings.Builder
+	b.WriteString("Date,Time,IMP\n")
+	base := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= 24; i++ {
+		tm := base.Add(time.Minute * 5 * time.Duration(i))
+		fmt.Fprintf(&b, "%s,%s,%.1f\n", tm.Format("2006-01-02"), tm.Format("15:04"), 100+float64(i)/10)
+	}
+	if err := os.WriteFile(filepath.Join(csvDir, "2022-04-01.csv"), []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	savedDB, savedLoc, savedStitch, savedRollback := db, csvLoc, *stitch, *rollbackFile
+	defer func() {
+		db, csvLoc, *stitch, *rollbackFile = savedDB, savedLoc, savedStitch, savedRollback
+	}()
+	csvLoc, *rollbackFile = time.UTC, filepath.Join(dir, "rollback.sql")
+	// The existing records start at 01:00, with sums of 10 and 11.
+	existing := "01:00=10 02:00=11"
+	tests := []struct {
+		mode     string
+		imported string // Records once imported
+	}{
+		{stitchExisting, "23:00=0 00:00=1.2 01:00=2.4 02:00=3.4"},
+		{stitchBackfill, "23:00=7.6 00:00=8.8 01:00=10 02:00=11"},
+	}
+	for i, tc := range tests {
+		*stitch = tc.mode
+		d, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, fmt.Sprintf("test%d.db", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		if err := createSchema(d); err != nil {
+			t.Fatal(err)
+		}
+		stmts := []string{fmt.Sprintf("INSERT INTO %s (id, statistic_id) VALUES (1, %s)", quoteIdent(metaName()), sqlQuote(selftestId))}
+		for _, r := range strings.Fields(existing) {
+			clock, sum, _ := strings.Cut(r, "=")
+			start, err := time.Parse(tFmt, "2022-04-01 "+clock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stmts = append(stmts, fmt.Sprintf("INSERT INTO %s (%s, %s, %s, %s) VALUES (%s, %s, %s, 1)", quoteIdent(longName()),
+				quoteIdent(createdCol()), quoteIdent(startCol()), quoteIdent("sum"), quoteIdent("metadata_id"),
+				timeValue(start.Add(time.Hour)), timeValue(start), sum))
+		}
+		for _, s := range stmts {
+			if _, err := d.Exec(s); err != nil {
+				t.Fatalf("%s: %v", s, err)
+			}
+		}
+		db = d
+		j := &job{name: "test", dir: csvDir, stats: []*stat{{name: "import", column: "IMP", id: selftestId, key: 1, unit: "kWh", scale: 1}}}
+		closeRollback, err := openRollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+		script, err := captureSQL(func() error { return generate(context.Background(), []*job{j}, span{}, span{}) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := closeRollback(); err != nil {
+			t.Fatal(err)
+		}
+		for _, step := range []struct {
+			name   string
+			script []byte
+			want   string
+		}{
+			{"imported", script, tc.imported},
+			{"rolled back", nil, existing},
+		} {
+			if step.script == nil {
+				if step.script, err = os.ReadFile(*rollbackFile); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, _, err := applySQL(context.Background(), d, step.script); err != nil {
+				t.Fatalf("%s: %s: %v", tc.mode, step.name, err)
+			}
+			if got := longSums(t, d); !sameSums(got, step.want) {
+				t.Errorf("%s: %s: records %s, expected %s", tc.mode, step.name, got, step.want)
+			}
+		}
+	}
+}
+
+// longSums returns the long term records as space separated hh:mm=sum.
+func longSums(t *testing.T, d *sql.DB) string {
+	rows, err := d.Query(fmt.Sprintf("SELECT %s, %s FROM %s ORDER BY %s", timeSQL(startCol()), quoteIdent("sum"),
+		quoteIdent(longName()), quoteIdent(startCol())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var recs []string
+	for rows.Next() {
+		var start string
+		var sum float64
+		if err := rows.Scan(&start, &sum); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, fmt.Sprintf("%s=%g", start[11:16], math.Round(sum*100)/100))
+	}
+	return strings.Join(recs, " ")
+}
+
+// sameSums returns true if the records have the same times and sums.
+func sameSums(got, want string) bool {
+	g, w := strings.Fields(got), strings.Fields(want)
+	if len(g) != len(w) {
+		return false
+	}
+	for i := range g {
+		gt, gs, _ := strings.Cut(g[i], "=")
+		wt, ws, _ := strings.Cut(w[i], "=")
+		var gv, wv float64
+		fmt.Sscan(gs, &gv)
+		fmt.Sscan(ws, &wv)
+		if gt != wt || math.Abs(gv-wv) > 0.01 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Summary of the run, as a table of each statistic's time range, number
+// of samples and total, with the quantities in human readable form, so that
+// the data can be reviewed before the SQL is applied.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var printSummary = flag.Bool("summary", false, "Print a summary table of the statistics to standard error after generating the SQL")
+
+// summaryTable prints the summary of each job's statistics.
+func summaryTable(jobs []*job, elapsed time.Duration) {
+	w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "JOB\tSTATISTIC\tFROM\tTO\tPERIOD\tSAMPLES\tTOTAL\t")
+	for _, j := range jobs {
+		stats, err := j.derived()
+		if err != nil {
+			log.Printf("%s: %v", j.name, err)
+			continue
+		}
+		for _, s := range stats {
+			n := len(s.values)
+			if n == 0 {
+				fmt.Fprintf(w, "%s\t%s\t-\t-\t-\t0\t-\t\n", j.name, s.name)
+				continue
+			}
+			first, last := s.values[0], s.values[n-1]
+			total := "-"
+			if !s.mean {
+				total = humanQuantity(float64(last.sum-first.sum), s.unit)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", j.name, s.name,
+				first.t.In(csvLoc).Format(tFmt), last.t.In(csvLoc).Format(tFmt),
+				humanDuration(last.t.Sub(first.t)), thousands(n), total)
+		}
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "%s in %s\n", runSummary(jobs), humanDuration(elapsed))
+}
+
+// thousands formats the number with thousands separators e.g 1,234,567.
+func thousands(n int) string {
+	s := fmt.Sprint(n)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	if neg {
+		s = "-" + s
+	}
+	return s
+}
+
+// Prefixes used to scale quantities, in increasing order.
+var unitPrefixes = []string{"", "k", "M", "G", "T"}
+
+// humanQuantity formats the quantity in the largest multiple of the unit
+// that keeps the value at least 1 e.g 12345 kWh is 12.35 MWh.
+// Units other than Wh or W are not scaled.
+func humanQuantity(v float64, unit string) string {
+	p, base := 0, unit
+	for i, pre := range unitPrefixes {
+		if pre != "" && strings.HasPrefix(unit, pre) && (unit[len(pre):] == "Wh" || unit[len(pre):] == "W") {
+			p, base = i, unit[len(pre):]
+		}
+	}
+	if base != "Wh" && base != "W" {
+		return strings.TrimSpace(fmt.Sprintf("%.2f %s", v, unit))
+	}
+	for p < len(unitPrefixes)-1 && math.Abs(v) >= 1000 {
+		v /= 1000
+		p++
+	}
+	return fmt.Sprintf("%.2f %s%s", v, unitPrefixes[p], base)
+}
+
+// humanDuration formats the duration in the two largest units
+// e.g 2y 3mo, 5d 4h, 3m 20s or 1.5s.
+func humanDuration(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%.1fs", d.Seconds())
+	}
+	units := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"y", time.Hour * 24 * 365},
+		{"mo", time.Hour * 24 * 30},
+		{"d", time.Hour * 24},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	}
+	var parts []string
+	for _, u := range units {
+		if d >= u.d || len(parts) != 0 {
+			parts = append(parts, fmt.Sprintf("%d%s", d/u.d, u.name))
+			d %= u.d
+		}
+		if len(parts) == 2 {
+			break
+		}
+	}
+	return strings.Join(parts, " ")
+}
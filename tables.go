@@ -0,0 +1,65 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Names of the statistics tables, which may be overridden to target
+// test databases, renamed tables, or a database other than the default.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+)
+
+var tablePrefix = flag.String("table-prefix", "", "Prefix of the table names e.g a database name such as homeassistant.")
+var longTable = flag.String("table", "statistics", "Name of the long term statistics table")
+var shortTable = flag.String("short-table", "statistics_short_term", "Name of the short term statistics table")
+var metaTable = flag.String("meta-table", "statistics_meta", "Name of the statistics metadata table")
+
+// Valid table names, and table prefixes.
+var tableRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+var prefixRe = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*\.)?$`)
+
+// checkTables validates the table names, since they are included in the SQL as is.
+func checkTables() error {
+	tables := []string{*longTable, *shortTable, *metaTable}
+	if *auditTable != "" {
+		tables = append(tables, *auditTable)
+	}
+	for _, t := range tables {
+		if !tableRe.MatchString(t) {
+			return fmt.Errorf("%s: invalid table name", t)
+		}
+	}
+	if !prefixRe.MatchString(*tablePrefix) {
+		return fmt.Errorf("%s: invalid table prefix", *tablePrefix)
+	}
+	return nil
+}
+
+// longName returns the name of the long term statistics table.
+func longName() string {
+	return *tablePrefix + *longTable
+}
+
+// shortName returns the name of the short term statistics table.
+func shortName() string {
+	return *tablePrefix + *shortTable
+}
+
+// metaName returns the name of the statistics metadata table.
+func metaName() string {
+	return *tablePrefix + *metaTable
+}
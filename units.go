@@ -0,0 +1,93 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Units embedded in column headers, and conversion between them.
+
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Matches a unit suffix in a header e.g "IMP (kWh)" or "gen_Wh"
+var unitSuffixRe = regexp.MustCompile(`(?i)[ _(\[]+(kwh|wh|mwh|kvarh|varh|mvarh|kvar|var|kw|w|v|a|m³|m3|l|°c|c|%)[)\]]?$`)
+
+// Units that can be converted, as a multiple of the base unit of their quantity.
+var unitTable = map[string]struct {
+	quantity string
+	factor   float64
+}{
+	"wh":    {"energy", 1},
+	"kwh":   {"energy", 1000},
+	"mwh":   {"energy", 1000000},
+	"w":     {"power", 1},
+	"kw":    {"power", 1000},
+	"varh":  {"reactive energy", 1},
+	"kvarh": {"reactive energy", 1000},
+	"mvarh": {"reactive energy", 1000000},
+	"var":   {"reactive power", 1},
+	"kvar":  {"reactive power", 1000},
+}
+
+// splitUnit splits a unit suffix from a header, returning the header
+// without the suffix and the unit, or an empty unit if there is no suffix.
+func splitUnit(header string) (string, string) {
+	m := unitSuffixRe.FindStringSubmatchIndex(header)
+	if m == nil || m[0] == 0 {
+		return header, ""
+	}
+	return header[:m[0]], header[m[2]:m[3]]
+}
+
+// convert returns the multiplier to convert values from one unit to another,
+// or false if the units cannot be converted.
+func convert(from, to string) (float64, bool) {
+	f, ok1 := unitTable[strings.ToLower(from)]
+	t, ok2 := unitTable[strings.ToLower(to)]
+	if !ok1 || !ok2 || f.quantity != t.quantity {
+		return 0, false
+	}
+	return f.factor / t.factor, true
+}
+
+// headerScale returns the multiplier for the values of a column
+// whose header specifies the unit. A warning is logged (once) if the
+// unit conflicts with the configuration of the statistic, in which
+// case the configuration takes precedence.
+func (s *stat) headerScale(unit string) float64 {
+	if s.unit == "" {
+		// No unit configured, so use the unit from the header.
+		s.unit = unit
+		return 1
+	}
+	f, ok := convert(unit, s.unit)
+	switch {
+	case !ok && !strings.EqualFold(unit, s.unit):
+		s.unitWarning("header unit %s conflicts with configured unit %s", unit, s.unit)
+	case ok && f != 1 && s.scale != 1:
+		s.unitWarning("header unit %s conflicts with configured scale %g", unit, s.scale)
+	case ok:
+		return f
+	}
+	return 1
+}
+
+// unitWarning logs a warning about the units of this statistic, once only.
+func (s *stat) unitWarning(format string, args ...interface{}) {
+	if !s.unitWarned {
+		s.unitWarned = true
+		s.logger().Printf(s.name+": "+format, args...)
+	}
+}
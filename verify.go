@@ -0,0 +1,105 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The verify command, run after the generated SQL has been applied,
+// which reads back the hourly statistics via the Home Assistant WebSocket API
+// and confirms that the sums match what was generated.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// Difference in sums that is treated as a discrepancy.
+const verifyTolerance = 0.001
+
+// Number of discrepancies listed per statistic.
+const verifyList = 10
+
+// verify compares the hourly sums of the jobs with those returned by the API.
+func verify(jobs []*job) {
+	if *haURL == "" {
+		log.Fatalf("verify requires -ha-url (or HA_URL or -ha-credentials)")
+	}
+	a, err := dialHA(*haURL, *haToken)
+	if err != nil {
+		log.Fatalf("%s: %v", *haURL, err)
+	}
+	defer a.Close()
+	failed := false
+	for _, j := range jobs {
+		if _, err := j.read(context.Background()); err != nil {
+			fatalf("%v", err)
+		}
+		stats, err := j.derived()
+		if err != nil {
+			fatalf("%v", err)
+		}
+		for _, s := range stats {
+			if s.mean {
+				continue
+			}
+			if s.id == "" {
+				log.Fatalf("%s: statistic_id required for API access", s.name)
+			}
+			recs := s.records(time.Hour, span{})
+			if len(recs) == 0 {
+				continue
+			}
+			res, err := a.statistics([]string{s.id}, recs[0].start)
+			if err != nil {
+				log.Fatalf("%s: %v", s.id, err)
+			}
+			have := make(map[int64]*float64)
+			for _, r := range res[s.id] {
+				t, err := r.startTime()
+				if err != nil {
+					log.Fatalf("%s: %v", s.id, err)
+				}
+				have[t.Unix()] = r.Sum
+			}
+			bad := 0
+			for _, r := range recs {
+				sum, ok := have[r.start.Unix()]
+				var msg string
+				switch {
+				case !ok:
+					msg = "missing"
+				case sum == nil:
+					msg = "no sum"
+				case math.Abs(*sum-float64(r.sum)) > verifyTolerance:
+					msg = fmt.Sprintf("sum is %f, expected %f", *sum, r.sum)
+				default:
+					continue
+				}
+				if bad < verifyList {
+					fmt.Printf("%s: %s: %s\n", s.id, r.start.Format(dbTimeFmt), msg)
+				}
+				bad++
+			}
+			fmt.Printf("%s: %d hours checked, %d discrepancies\n", s.id, len(recs), bad)
+			if bad != 0 {
+				failed = true
+			}
+		}
+	}
+	if failed {
+		exit(1)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2022 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Warnings about rows of a file, which are collapsed into a single
+// count per reason unless debugging, since a bad file may otherwise
+// produce thousands of identical warnings.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+)
+
+var debug = flag.Bool("debug", false, "Log every skipped row, rather than a count per file")
+
+// The warnings of one file.
+type rowWarnings struct {
+	file    string
+	log     *log.Logger
+	reasons []string // Reasons in the order first seen
+	counts  map[string]int
+}
+
+// add records a skipped row. The detail is logged immediately if debugging.
+func (w *rowWarnings) add(row int, reason, format string, args ...interface{}) {
+	if *debug {
+		w.log.Printf("%s: %d: %s: %s", w.file, row, reason, fmt.Sprintf(format, args...))
+	}
+	if w.counts == nil {
+		w.counts = make(map[string]int)
+	}
+	if w.counts[reason] == 0 {
+		w.reasons = append(w.reasons, reason)
+	}
+	w.counts[reason]++
+}
+
+// flush logs the count of skipped rows for each reason.
+func (w *rowWarnings) flush() {
+	for _, r := range w.reasons {
+		w.log.Printf("%s: %d rows skipped: %s", w.file, w.counts[r], r)
+	}
+}